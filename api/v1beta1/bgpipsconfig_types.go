@@ -17,6 +17,7 @@ limitations under the License.
 package v1beta1
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -29,28 +30,154 @@ type BGPIPsConfigSpec struct {
 	// Important: Run "make" to regenerate code after modifying this file
 
 	// Cidr is IpRange. Edit BGPIPsConfig_types.go to remove/update
-	Cidr    string      `json:"cidr"`
-	Free    uint        `json:"free,omitempty"`
-	Used    uint        `json:"used,omitempty"`
+	Cidr string `json:"cidr,omitempty"`
+	// Ranges are inclusive address ranges such as 10.0.1.10-10.0.1.50 making
+	// up the pool, alone or in addition to Cidr. They must not overlap.
+	Ranges []string `json:"ranges,omitempty"`
+	// Free is the number of addresses still available in Cidr.
+	Free uint `json:"free,omitempty"`
+	// Used is the number of addresses handed out from Cidr.
+	Used uint `json:"used,omitempty"`
+	// IPItems records every address handed out from Cidr.
 	IPItems *IPItemList `json:"ipItemList,omitempty"`
+	// NamespaceSelector limits the pool to services in matching namespaces.
+	// An unset selector matches every namespace.
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+	// ServiceSelector limits the pool to services with matching labels.
+	// An unset selector matches every service.
+	ServiceSelector *metav1.LabelSelector `json:"serviceSelector,omitempty"`
+	// Excludes are addresses never handed out, each entry is a single ip, a
+	// cidr or an inclusive range such as 10.0.0.1-10.0.0.9.
+	Excludes []string `json:"excludes,omitempty"`
+	// SkipNetworkBroadcast keeps the network and broadcast addresses of Cidr
+	// from being handed out. Defaults to true.
+	SkipNetworkBroadcast *bool `json:"skipNetworkBroadcast,omitempty"`
+	// AllocationStrategy picks which free address is handed out next.
+	// Defaults to sequential.
+	// +kubebuilder:validation:Enum=sequential;random;least-recently-released
+	AllocationStrategy string `json:"allocationStrategy,omitempty"`
+	// DrainPolicy decides what happens to the services holding ips of the
+	// pool once it is deleted: Keep lets them keep their ips until they give
+	// them up, Migrate moves them to other pools. The pool stays until its
+	// last ip is released. Defaults to the --drain-policy flag.
+	// +kubebuilder:validation:Enum=Keep;Migrate
+	DrainPolicy string `json:"drainPolicy,omitempty"`
+	// Priority orders the pools services get ips from, pools of a higher
+	// priority are used first. Pools of the same priority are used in the
+	// order they were added unless --spread-pools balances ips across them.
+	// +optional
+	Priority int `json:"priority,omitempty"`
+	// Weight is the share of the ips balanced across the pools of the same
+	// priority this pool takes, relative to the weight of the other pools.
+	// Defaults to 1.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	Weight int `json:"weight,omitempty"`
+	// AutoAssign lets services get ips of the pool without asking for them.
+	// When false the ips are only handed out to services asking for the pool
+	// with the lb.lambdahj.site/pool annotation or for one of its ips with
+	// spec.loadBalancerIP. Defaults to true.
+	// +optional
+	AutoAssign *bool `json:"autoAssign,omitempty"`
 }
 
 type IPItemList struct {
-	IPs []string `json:"ips,omitempty"`
+	// IPs are the addresses handed out as recorded by earlier versions,
+	// without their holders. They are no longer written, the holders are
+	// restored from the status of the services at startup instead.
+	IPs   []string `json:"ips,omitempty"`
+	Items []IPItem `json:"items,omitempty"`
+	// Released records when the addresses nobody holds anymore were released.
+	Released []ReleasedIP `json:"released,omitempty"`
 }
 
-func (ipl *IPItemList) IsInUsed(ip string) bool {
+// IPItem is a single address handed out from the pool.
+type IPItem struct {
+	IP string `json:"ip"`
+	// Owner is the namespace/name of the service holding IP.
+	Owner string `json:"owner,omitempty"`
+	// SharingKey lets services with the same key hold IP together.
+	SharingKey string `json:"sharingKey,omitempty"`
+	// Ports are the ports Owner uses on IP, formatted as protocol/port.
+	Ports []string `json:"ports,omitempty"`
+}
+
+// ReleasedIP is an address given back to the pool.
+type ReleasedIP struct {
+	IP string `json:"ip"`
+	// Owner is the namespace/name of the service which held IP last.
+	Owner string      `json:"owner,omitempty"`
+	Time  metav1.Time `json:"time"`
+}
 
+func (ipl *IPItemList) IsInUsed(ip string) bool {
+	if ipl == nil {
+		return false
+	}
+	for i := range ipl.Items {
+		if ipl.Items[i].IP == ip {
+			return true
+		}
+	}
+	for _, used := range ipl.IPs {
+		if used == ip {
+			return true
+		}
+	}
 	return false
 }
 
 // BGPIPsConfigStatus defines the observed state of BGPIPsConfig
 type BGPIPsConfigStatus struct {
-	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
-	// Important: Run "make" to regenerate code after modifying this file
+	// Total is the number of addresses the pool may hand out.
+	Total uint `json:"total"`
+	// Used is the number of addresses handed out.
+	Used uint `json:"used"`
+	// Free is the number of addresses still available.
+	Free uint `json:"free"`
+	// Allocations lists every address handed out with the services holding it.
+	Allocations []IPAllocation `json:"allocations,omitempty"`
+	// LastUpdated is when the status last changed.
+	LastUpdated *metav1.Time `json:"lastUpdated,omitempty"`
+	// Conditions are the latest observations of the state of the pool.
+	Conditions []PoolCondition `json:"conditions,omitempty"`
+}
+
+const (
+	// PoolConditionDraining is true while a deleted pool waits for the
+	// services holding its ips to give them up.
+	PoolConditionDraining = "Draining"
+	// PoolConditionConflicting is true while the pool overlaps addresses of
+	// the cluster, such as node or pod addresses, which it does not hand out.
+	PoolConditionConflicting = "Conflicting"
+	// PoolConditionInvalid is true when the pool cannot be used, for example
+	// because it overlaps another pool.
+	PoolConditionInvalid = "Invalid"
+)
+
+// PoolCondition is an observation of the state of a pool.
+type PoolCondition struct {
+	Type               string                 `json:"type"`
+	Status             corev1.ConditionStatus `json:"status"`
+	LastTransitionTime metav1.Time            `json:"lastTransitionTime,omitempty"`
+	Reason             string                 `json:"reason,omitempty"`
+	Message            string                 `json:"message,omitempty"`
+}
+
+// IPAllocation is an address handed out from the pool.
+type IPAllocation struct {
+	IP string `json:"ip"`
+	// Services are the namespace/name of the services holding IP.
+	Services []string `json:"services,omitempty"`
 }
 
 // +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Cidr",type=string,JSONPath=`.spec.cidr`
+// +kubebuilder:printcolumn:name="Total",type=integer,JSONPath=`.status.total`
+// +kubebuilder:printcolumn:name="Used",type=integer,JSONPath=`.status.used`
+// +kubebuilder:printcolumn:name="Free",type=integer,JSONPath=`.status.free`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
 // BGPIPsConfig is the Schema for the bgpipsconfigs API
 type BGPIPsConfig struct {
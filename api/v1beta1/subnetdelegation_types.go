@@ -0,0 +1,85 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// SubnetDelegationSpec defines the desired state of SubnetDelegation
+type SubnetDelegationSpec struct {
+	// Pool is the name of the BGPIPsConfig the subnet is carved out of.
+	Pool string `json:"pool"`
+	// Namespace is delegated the subnet, its services get ips from their
+	// delegated subnets only and no other namespace gets ips from them.
+	Namespace string `json:"namespace"`
+	// Cidr is the subnet to delegate, it must be part of the pool.
+	// +optional
+	Cidr string `json:"cidr,omitempty"`
+	// PrefixLength picks the first free subnet of that length in the pool
+	// when Cidr is unset.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=128
+	// +optional
+	PrefixLength int `json:"prefixLength,omitempty"`
+}
+
+// SubnetDelegationStatus defines the observed state of SubnetDelegation
+type SubnetDelegationStatus struct {
+	// Cidr is the delegated subnet, it stays the same once picked.
+	Cidr string `json:"cidr,omitempty"`
+	// Total is the number of addresses of the subnet which may be handed out.
+	Total uint `json:"total"`
+	// Used is the number of addresses of the subnet handed out.
+	Used uint `json:"used"`
+	// Free is the number of addresses of the subnet still available.
+	Free uint `json:"free"`
+	// Conditions are the latest observations of the state of the delegation.
+	Conditions []PoolCondition `json:"conditions,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:scope=Cluster
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Pool",type=string,JSONPath=`.spec.pool`
+// +kubebuilder:printcolumn:name="Namespace",type=string,JSONPath=`.spec.namespace`
+// +kubebuilder:printcolumn:name="Cidr",type=string,JSONPath=`.status.cidr`
+// +kubebuilder:printcolumn:name="Used",type=integer,JSONPath=`.status.used`
+// +kubebuilder:printcolumn:name="Free",type=integer,JSONPath=`.status.free`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// SubnetDelegation is the Schema for the subnetdelegations API
+type SubnetDelegation struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   SubnetDelegationSpec   `json:"spec,omitempty"`
+	Status SubnetDelegationStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// SubnetDelegationList contains a list of SubnetDelegation
+type SubnetDelegationList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []SubnetDelegation `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&SubnetDelegation{}, &SubnetDelegationList{})
+}
@@ -18,7 +18,10 @@ package controllers
 
 import (
 	"context"
-	"sync"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/LambdaHJ/bgplb/api/v1beta1"
 	"github.com/LambdaHJ/bgplb/pkg/ipam"
@@ -28,105 +31,229 @@ import (
 	"github.com/go-logr/logr"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 )
 
 const finalizer string = "finalizer.lb.lambdahj.site/v1beta1"
 
 const listPageSize = 50
 
+// pendingRetry is how long a service left short of ips waits before it is
+// reconciled again, pools added or grown requeue it right away.
+const pendingRetry = time.Minute
+
+// poolAnnotation asks for ips from the given pools, a comma separated list
+// tried in order.
+const poolAnnotation = "lb.lambdahj.site/pool"
+
+// sharingKeyAnnotation lets services of a namespace with the same key share
+// an ip as long as their ports do not overlap.
+const sharingKeyAnnotation = "lb.lambdahj.site/sharing-key"
+
+// ipCountAnnotation asks for several ips per ip family, 1 if unset.
+const ipCountAnnotation = "lb.lambdahj.site/ip-count"
+
+// distinctPoolsAnnotation, set to "true", takes every ip of a family from a
+// different pool.
+const distinctPoolsAnnotation = "lb.lambdahj.site/distinct-pools"
+
 // BGPConfigReconciler reconciles a BGPConfig object
 type BGPConfigReconciler struct {
-	Locker sync.Mutex
 	client.Client
 	Log    logr.Logger
 	Scheme *runtime.Scheme
-	ipam   *ipam.IPAMManager
+	// IPAM is shared with the BGPIPsConfigReconciler.
+	IPAM     *ipam.IPAMManager
+	Recorder record.EventRecorder
+	// ServiceCache serves the services as unstructured objects, which keep
+	// spec.ipFamilies and spec.ipFamilyPolicy the typed Service does not
+	// have yet. Client does not cache unstructured reads, the manager cache
+	// does.
+	ServiceCache client.Reader
+	// DefaultQuota caps the ips of the namespaces without ipQuotaAnnotation,
+	// 0 means no cap.
+	DefaultQuota int
+	// MaxConcurrentReconciles is the number of services reconciled at the
+	// same time, 1 if unset.
+	MaxConcurrentReconciles int
+	// PoolNamespace is the namespace of the BGPIPsConfigs.
+	PoolNamespace string
+	// RebuildPolicy decides what Init does about services claiming the same
+	// ip or ips outside of every pool, RebuildKeepOldest if unset.
+	RebuildPolicy string
+
+	// namespaces serializes the ip acquisitions of the services of a
+	// namespace, which share its quota.
+	namespaces namespaceLocks
+	// pending requeues the services still waiting for an ip.
+	pending chan event.GenericEvent
 }
 
+// Init restores the pools, the delegations and the allocations, which are
+// rebuilt from the status of the services.
 func (r *BGPConfigReconciler) Init(reader client.Reader) error {
 	ctx := context.Background()
 	reqLog := r.Log.WithValues("init", "BGPConfigReconciler")
 
-	r.ipam = ipam.NewIPAMManager()
+	if err := r.LoadPools(reader); err != nil {
+		return err
+	}
+	if err := r.initDelegations(ctx, reader); err != nil {
+		return err
+	}
+
+	// The rebuilt allocations are saved by a single flush once they are all
+	// restored.
+	var err error
+	flushErr := r.IPAM.Batch(func() {
+		err = r.rebuild(ctx, reader)
+	})
+	if err != nil {
+		reqLog.Error(err, "rebuild allocations error")
+		return err
+	}
+	if flushErr != nil {
+		reqLog.Error(flushErr, "save allocations error")
+		return flushErr
+	}
+	reqLog.Info("Contriller init success")
+
+	return nil
+}
+
+// LoadPools adds the pools of the BGPIPsConfigs and of the Calico cidrs
+// together with the allocations of the store, nothing else is looked at.
+func (r *BGPConfigReconciler) LoadPools(reader client.Reader) error {
+	ctx := context.Background()
+	reqLog := r.Log.WithValues("init", "BGPConfigReconciler")
+
+	pools := &v1beta1.BGPIPsConfigList{}
+	if err := reader.List(ctx, pools, client.InNamespace(r.PoolNamespace)); err != nil {
+		reqLog.Error(err, "List BGPIPsConfig error")
+		return err
+	}
+	for i := range pools.Items {
+		// The pools of the Calico cidrs still listed are added below. Those
+		// of cidrs removed while the manager was down are restored as long
+		// as they have allocations, for the CalicoConfigReconciler to drain
+		// them.
+		if ipam.IsCalicoConfig(&pools.Items[i]) {
+			r.restoreCalicoPool(&pools.Items[i])
+			continue
+		}
+		pool, err := ipam.PoolFromConfig(&pools.Items[i])
+		if err == nil {
+			err = r.IPAM.AddPool(pool)
+		}
+		if err != nil {
+			reqLog.Error(err, "add pool error", "pool", pools.Items[i].Name)
+		}
+	}
+
+	// Without a BGPConfiguration there are no Calico cidrs, the services
+	// still need to be restored.
 	bgpConf := &v1beta1.BGPConfiguration{}
 	nq := types.NamespacedName{Name: "default"}
 	err := reader.Get(ctx, nq, bgpConf)
-	if err != nil {
-		if errors.IsNotFound(err) {
-			return nil
-		}
+	if err != nil && !errors.IsNotFound(err) {
 		return err
 	}
 
 	for _, cidr := range bgpConf.Spec.ServiceExternalIPs {
-		if err := r.ipam.NewCidr(cidr.Cidr); err != nil {
+		if err := r.IPAM.NewCidr(cidr.Cidr); err != nil {
 			reqLog.Error(err, "creat cidr error")
 		}
 	}
+	return nil
+}
 
-	svcs := &corev1.ServiceList{}
-	filterOptions := &client.ListOptions{Limit: listPageSize}
-	for {
-		err = reader.List(ctx, svcs, filterOptions)
-		if err != nil {
-			reqLog.Error(err, "List service error")
-			return err
-		}
-		for _, item := range svcs.Items {
-			if item.Spec.Type != corev1.ServiceTypeLoadBalancer {
-				continue
-			}
-
-			r.ipam.AddUsedIP(item.Status.LoadBalancer.Ingress[0].IP)
-			reqLog.Info("add used ip", "ip", item.Status.LoadBalancer.Ingress[0].IP, "service", item.Name)
+// restoreCalicoPool adds the Calico pool whose state and status conf holds,
+// unless neither the store nor the status of conf has allocations of it.
+// The status covers the stores losing them on restart, the services give
+// them back.
+func (r *BGPConfigReconciler) restoreCalicoPool(conf *v1beta1.BGPIPsConfig) {
+	err := r.IPAM.AddPool(&ipam.Pool{Name: conf.Name, Cidr: conf.Spec.Cidr, FromCalico: true})
+	if err != nil {
+		r.Log.Error(err, "add calico pool error", "pool", conf.Name)
+		return
+	}
+	if status := r.IPAM.Status(conf.Name); status != nil && status.Used == 0 && conf.Status.Used == 0 {
+		if err := r.IPAM.RemovePool(conf.Name); err != nil {
+			r.Log.Error(err, "remove calico pool error", "pool", conf.Name)
 		}
+	}
+}
 
-		if svcs.Continue == "" {
-			break
+// initDelegations applies the SubnetDelegations once their pools exist, the
+// services of a namespace with delegations get their ips from them only.
+func (r *BGPConfigReconciler) initDelegations(ctx context.Context, reader client.Reader) error {
+	delegations := &v1beta1.SubnetDelegationList{}
+	if err := reader.List(ctx, delegations); err != nil {
+		r.Log.Error(err, "List SubnetDelegation error")
+		return err
+	}
+	for i := range delegations.Items {
+		if _, err := r.IPAM.Delegate(ipam.DelegationFromObject(&delegations.Items[i])); err != nil {
+			r.Log.Error(err, "delegate subnet error", "subnetdelegation", delegations.Items[i].Name)
 		}
-		filterOptions.Continue = svcs.Continue
-		svcs.Continue = ""
 	}
-	reqLog.Info("Contriller init success")
-
 	return nil
 }
 
 // +kubebuilder:rbac:groups=core,resources=services,verbs=get;list;watch;create;update;patch
 // +kubebuilder:rbac:groups=core,resources=services/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=core,resources=configmaps,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=core,resources=namespaces,verbs=get;list;watch
+// +kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
 // +kubebuilder:rbac:groups=crd.projectcalico.org,resources=bgpconfigurations,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=lb.lambdahj.site,resources=bgpipsconfigs,verbs=get;list;watch;create;update;patch;delete
 
 func (r *BGPConfigReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
-	r.Locker.Lock()
-	defer r.Locker.Unlock()
 	ctx := context.Background()
 	reqLog := r.Log.WithValues("bgpconfig", req.NamespacedName)
+	owner := req.NamespacedName.String()
 
 	svc := &corev1.Service{}
 	err := r.Get(ctx, req.NamespacedName, svc)
 	if err != nil {
 		if errors.IsNotFound(err) {
-			return ctrl.Result{}, nil
+			// The ips are remembered for owner in case the service comes back.
+			ips, err := r.IPAM.ReleaseOwner(owner)
+			if len(ips) > 0 {
+				reqLog.Info("remove ip", "ip", ips)
+				// The quota freed may let other services of the namespace
+				// get their ips.
+				r.requeueNamespace(ctx, req.Namespace)
+			}
+			return ctrl.Result{}, err
 		}
 		return ctrl.Result{}, err
 	}
 
 	if util.IsDeletionCandidate(svc, finalizer) {
-		if util.IsNeedReleaseIP(svc, true) {
-			r.ipam.ReleaseIP(svc.Status.LoadBalancer.Ingress[0].IP)
-			reqLog.Info("remove ip", "ip", svc.Status.LoadBalancer.Ingress[0].IP)
+		for _, ip := range util.NeedReleaseIPs(svc, nil, 0, true) {
+			r.IPAM.ReleaseIP(ip, owner)
+			reqLog.Info("remove ip", "ip", ip)
 		}
 		controllerutil.RemoveFinalizer(svc, finalizer)
 		svc.Status.LoadBalancer.Ingress = nil
 		err = r.Update(ctx, svc)
 		reqLog.Info("RemoveFinalizer", "finalizer", svc.Finalizers, "err", err)
+		r.requeueNamespace(ctx, req.Namespace)
 		return ctrl.Result{}, err
 	}
 
@@ -139,48 +266,477 @@ func (r *BGPConfigReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 		// }
 	}
 
-	if util.IsNeedReleaseIP(svc, false) {
-		r.ipam.ReleaseIP(svc.Status.LoadBalancer.Ingress[0].IP)
-		reqLog.Info("remove ip", "ip", svc.Status.LoadBalancer.Ingress[0].IP)
-		svc.Status.LoadBalancer.Ingress = nil
+	raw, err := r.rawService(ctx, req.NamespacedName)
+	if err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	families, policy, err := util.ServiceIPFamilies(svc, raw)
+	if err != nil {
+		r.Recorder.Event(svc, corev1.EventTypeWarning, "InvalidIPFamilies", err.Error())
+		return ctrl.Result{}, err
 	}
 
-	// if !util.IsNeedAssignIP(svc) {
-	// 	return ctrl.Result{}, nil
-	// }
+	ipReq, ns, err := r.newRequest(ctx, svc)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	// Pools asked for which are missing or draining hand out no ip, the
+	// service waits for them once the ips it gives up are released. Adding
+	// a pool requeues it.
+	unusable := r.unusablePools(ipReq.Pools)
+	usable := len(unusable) < len(ipReq.Pools) || len(ipReq.Pools) == 0
+	if len(unusable) > 0 && svc.Spec.Type == corev1.ServiceTypeLoadBalancer {
+		r.Recorder.Eventf(svc, corev1.EventTypeWarning, "PoolUnavailable",
+			"pools %s are missing or draining", strings.Join(unusable, ", "))
+	}
+	count, err := ipCount(svc)
+	if err != nil {
+		r.Recorder.Event(svc, corev1.EventTypeWarning, "InvalidIPCount", err.Error())
+		return ctrl.Result{}, err
+	}
+	distinct := svc.Annotations[distinctPoolsAnnotation] == "true"
 
-	var ip string
-	if svc.Spec.LoadBalancerIP != "" {
-		reqLog.Info("specific ip", "ip", svc.Spec.LoadBalancerIP)
-		if !r.ipam.AcquireSpecificIP(svc.Spec.LoadBalancerIP) {
-			reqLog.Info("get specific ip error")
-			return ctrl.Result{}, nil
+	releases := util.NeedReleaseIPs(svc, families, count, false)
+	if len(ipReq.Pools) > 0 && usable {
+		// Move ips out of pools which are no longer requested.
+		for _, item := range svc.Status.LoadBalancer.Ingress {
+			if !util.ContainsString(ipReq.Pools, r.IPAM.PoolOf(item.IP)) && !util.ContainsString(releases, item.IP) {
+				releases = append(releases, item.IP)
+			}
+		}
+	}
+	// Ips whose other holders now use the same ports, or no longer share the
+	// sharing key of svc, are given up for new ones.
+	for _, item := range svc.Status.LoadBalancer.Ingress {
+		if util.ContainsString(releases, item.IP) {
+			continue
 		}
-		ip = svc.Spec.LoadBalancerIP
+		if err := r.IPAM.Refresh(item.IP, ipReq); err != nil {
+			reqLog.Info("ip no longer shareable", "ip", item.IP, "reason", err.Error())
+			r.Recorder.Eventf(svc, corev1.EventTypeWarning, "IPNotShareable", "%v, moving to another ip", err)
+			releases = append(releases, item.IP)
+		}
+	}
+	ingress := make([]corev1.LoadBalancerIngress, 0, len(svc.Status.LoadBalancer.Ingress))
+	for _, item := range svc.Status.LoadBalancer.Ingress {
+		if util.ContainsString(releases, item.IP) {
+			r.IPAM.ReleaseIP(item.IP, owner)
+			reqLog.Info("remove ip", "ip", item.IP)
+			continue
+		}
+		ingress = append(ingress, item)
+	}
+
+	// Ips of draining pools are moved to other pools, they are only given up
+	// once their replacement is acquired.
+	var migrating []string
+	for _, item := range ingress {
+		if r.IPAM.Migrating(item.IP) {
+			migrating = append(migrating, item.IP)
+		}
+	}
 
-	} else {
-		ip, err = r.ipam.AcquireIP()
+	var acquired, migrated []string
+	// pending is set when svc is left short of ips, it is retried after
+	// pendingRetry in case nothing else requeues it.
+	pending := false
+	if svc.Spec.Type == corev1.ServiceTypeLoadBalancer && usable {
+		// The quota is checked once the ips to release are given back.
+		r.namespaces.Lock(svc.Namespace)
+		q, err := r.quotaLeft(ns)
 		if err != nil {
-			reqLog.Error(err, "acquire ip error")
-			return ctrl.Result{}, nil
+			r.namespaces.Unlock(svc.Namespace)
+			r.Recorder.Event(svc, corev1.EventTypeWarning, "InvalidQuota", err.Error())
+			return ctrl.Result{}, err
+		}
+		failed := false
+		for i, family := range families {
+			taken := ingressOfFamily(ingress, family)
+			// Every migrating ip takes a slot for its replacement, then every
+			// missing ip takes one, "".
+			var slots []string
+			kept := 0
+			for _, ip := range taken {
+				if util.ContainsString(migrating, ip) && ip != svc.Spec.LoadBalancerIP {
+					slots = append(slots, ip)
+				} else {
+					// spec.loadBalancerIP pins the ip even to a draining pool.
+					kept++
+				}
+			}
+			for n := len(taken); n < count; n++ {
+				slots = append(slots, "")
+			}
+			for _, old := range slots {
+				migrate := old != ""
+				var ip string
+				// An ip svc still holds in the ipam, e.g. after its status was
+				// wiped, is counted against the quota already.
+				reclaim := !migrate && r.heldIP(svc, ipReq, family, taken, distinct) != ""
+				exceeded := !migrate && !reclaim && q.left == 0
+				switch {
+				case exceeded:
+					err = fmt.Errorf("namespace %s has no ip quota left", svc.Namespace)
+				case reclaim:
+					ip, err = r.acquireIP(svc, ipReq, family, taken, distinct)
+				default:
+					// The pool quotas are checked again for every ip.
+					ip, err = r.acquireIP(svc, q.request(ipReq), family, taken, distinct)
+				}
+				// Joining an ip the namespace holds already takes no quota.
+				if err != nil && ipReq.SharingKey != "" {
+					join := *ipReq
+					join.ShareOnly = true
+					if shared, joinErr := r.acquireIP(svc, &join, family, taken, distinct); joinErr == nil {
+						ip, err = shared, nil
+					}
+				}
+				switch {
+				case err == nil || migrate:
+				case exceeded:
+					r.Recorder.Event(svc, corev1.EventTypeWarning, "QuotaExceeded", err.Error())
+				default:
+					r.Recorder.Eventf(svc, corev1.EventTypeWarning, "AcquireIPFailed", "no %s ip available: %v", family, err)
+				}
+				if err != nil {
+					reqLog.Error(err, "acquire ip error", "family", family)
+					pending = true
+					if migrate {
+						// The ip stays until a replacement is found.
+						kept++
+						continue
+					}
+					// The primary family always needs an ip, the others only
+					// for RequireDualStack.
+					if kept == 0 && (i == 0 || policy == util.IPFamilyPolicyRequireDualStack) {
+						r.releaseIPs(acquired, owner)
+						acquired, migrated = nil, nil
+						failed = true
+					}
+					break
+				}
+				taken = append(taken, ip)
+				acquired = append(acquired, ip)
+				kept++
+				// Sharing keys are scoped to the namespace, an ip with other
+				// holders is counted for it already.
+				if !reclaim && len(r.IPAM.Holders(ip)) == 1 {
+					q.take(r.IPAM.PoolOf(ip), migrate)
+				}
+				if migrate {
+					migrated = append(migrated, old)
+				}
+			}
+			if failed {
+				break
+			}
 		}
+		r.namespaces.Unlock(svc.Namespace)
 	}
 
-	svc.Status.LoadBalancer.Ingress = append(svc.Status.LoadBalancer.Ingress, corev1.LoadBalancerIngress{IP: ip})
+	result := ctrl.Result{}
+	if pending {
+		result.RequeueAfter = pendingRetry
+	}
+	if len(releases) == 0 && len(acquired) == 0 {
+		return result, nil
+	}
+	if len(migrated) > 0 {
+		kept := ingress[:0]
+		for _, item := range ingress {
+			if !util.ContainsString(migrated, item.IP) {
+				kept = append(kept, item)
+			}
+		}
+		ingress = kept
+	}
+	for _, ip := range acquired {
+		ingress = append(ingress, corev1.LoadBalancerIngress{IP: ip})
+	}
+	svc.Status.LoadBalancer.Ingress = ingress
 
 	err = r.Status().Update(context.Background(), svc)
-	reqLog.Info("Assign exterinal IP", "IP", ip)
+	reqLog.Info("Assign exterinal IP", "IP", acquired)
 	if err != nil {
+		r.releaseIPs(acquired, owner)
 		return ctrl.Result{}, err
 	}
+	for _, ip := range migrated {
+		r.IPAM.ReleaseIP(ip, owner)
+		reqLog.Info("migrate ip", "ip", ip)
+	}
 
-	return ctrl.Result{}, nil
+	return result, nil
+}
+
+// newRequest describes svc to the ipam, the labels of its namespace decide
+// which pools it may use and poolAnnotation narrows them down, whether the
+// pools it names exist or not. The namespace of svc is returned as well.
+func (r *BGPConfigReconciler) newRequest(ctx context.Context, svc *corev1.Service) (*ipam.Request, *corev1.Namespace, error) {
+	ns := &corev1.Namespace{}
+	if err := r.Get(ctx, types.NamespacedName{Name: svc.Namespace}, ns); err != nil {
+		return nil, nil, err
+	}
+	ipReq := serviceRequest(svc)
+	ipReq.Labels = labels.Set(svc.Labels)
+	ipReq.NamespaceLabels = labels.Set(ns.Labels)
+	if pools, ok := svc.Annotations[poolAnnotation]; ok {
+		for _, name := range strings.Split(pools, ",") {
+			if name = strings.TrimSpace(name); name == "" {
+				continue
+			}
+			ipReq.Pools = append(ipReq.Pools, name)
+		}
+	}
+	return ipReq, ns, nil
+}
+
+// unusablePools returns the pools of names which are missing or draining.
+func (r *BGPConfigReconciler) unusablePools(names []string) []string {
+	var unusable []string
+	for _, name := range names {
+		if status := r.IPAM.Status(name); status == nil || status.Draining {
+			unusable = append(unusable, name)
+		}
+	}
+	return unusable
+}
+
+// rawService returns the service key as an unstructured object.
+func (r *BGPConfigReconciler) rawService(ctx context.Context, key types.NamespacedName) (*unstructured.Unstructured, error) {
+	raw := &unstructured.Unstructured{}
+	raw.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("Service"))
+	if err := r.ServiceCache.Get(ctx, key, raw); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+// serviceRequest returns the ipam request identifying svc. Sharing keys are
+// scoped to the namespace of svc.
+func serviceRequest(svc *corev1.Service) *ipam.Request {
+	ipReq := &ipam.Request{
+		Owner: svc.Namespace + "/" + svc.Name,
+		Ports: util.ServicePorts(svc),
+	}
+	if key := svc.Annotations[sharingKeyAnnotation]; key != "" {
+		ipReq.SharingKey = svc.Namespace + "/" + key
+	}
+	return ipReq
+}
+
+// acquireIP acquires an ip of family for svc other than the taken ones,
+// honoring spec.loadBalancerIP when it is of the same family, or hands back
+// an ip svc already holds. With distinct set the pools of taken are avoided.
+func (r *BGPConfigReconciler) acquireIP(svc *corev1.Service, req *ipam.Request, family corev1.IPFamily, taken []string, distinct bool) (string, error) {
+	req = r.distinctRequest(req, taken, distinct)
+	pinned := svc.Spec.LoadBalancerIP
+	if pinned != "" && util.IPFamilyOf(pinned) == family && !util.ContainsString(taken, pinned) {
+		if !r.IPAM.AcquireSpecificIP(pinned, req) {
+			return "", fmt.Errorf("get specific ip %s error", pinned)
+		}
+		return pinned, nil
+	}
+	if ip := r.heldIP(svc, req, family, taken, distinct); ip != "" {
+		return ip, nil
+	}
+	return r.IPAM.AcquireIP(req, family)
+}
+
+// heldIP returns the ip of family acquireIP would hand back because svc
+// holds it already, or "" when it would acquire one.
+func (r *BGPConfigReconciler) heldIP(svc *corev1.Service, req *ipam.Request, family corev1.IPFamily, taken []string, distinct bool) string {
+	req = r.distinctRequest(req, taken, distinct)
+	pinned := svc.Spec.LoadBalancerIP
+	if pinned != "" && util.IPFamilyOf(pinned) == family && !util.ContainsString(taken, pinned) {
+		if util.ContainsString(r.IPAM.Holders(pinned), req.Owner) {
+			return pinned
+		}
+		return ""
+	}
+	for _, ip := range r.IPAM.Held(req, family) {
+		if util.ContainsString(taken, ip) || distinct && util.ContainsString(req.SkipPools, r.IPAM.PoolOf(ip)) {
+			continue
+		}
+		return ip
+	}
+	return ""
+}
+
+// distinctRequest returns req with the pools of taken skipped when distinct
+// is set.
+func (r *BGPConfigReconciler) distinctRequest(req *ipam.Request, taken []string, distinct bool) *ipam.Request {
+	if !distinct {
+		return req
+	}
+	skip := *req
+	skip.SkipPools = append([]string(nil), req.SkipPools...)
+	for _, ip := range taken {
+		skip.SkipPools = append(skip.SkipPools, r.IPAM.PoolOf(ip))
+	}
+	return &skip
+}
+
+// ipCount returns the number of ips per family svc asks for.
+func ipCount(svc *corev1.Service) (int, error) {
+	s, ok := svc.Annotations[ipCountAnnotation]
+	if !ok {
+		return 1, nil
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || count < 1 {
+		return 0, fmt.Errorf("invalid %s %q", ipCountAnnotation, s)
+	}
+	return count, nil
+}
+
+func (r *BGPConfigReconciler) releaseIPs(ips []string, owner string) {
+	for _, ip := range ips {
+		r.IPAM.ReleaseIP(ip, owner)
+	}
+}
+
+// RequeuePending requeues every LoadBalancer service without all of its
+// ips, it is called once new pools become available.
+func (r *BGPConfigReconciler) RequeuePending(ctx context.Context) error {
+	pending, err := r.pendingServices(ctx)
+	if err != nil {
+		return err
+	}
+	r.requeue(pending)
+	return nil
+}
+
+// requeueNamespace requeues the LoadBalancer services of namespace without
+// all of their ips, e.g. once it has quota left again. It never blocks.
+func (r *BGPConfigReconciler) requeueNamespace(ctx context.Context, namespace string) {
+	pending, err := r.pendingServices(ctx, client.InNamespace(namespace))
+	if err != nil {
+		r.Log.Error(err, "list pending services error", "namespace", namespace)
+		return
+	}
+	r.requeue(pending)
+}
+
+// namespacePending maps a namespace to its pending services.
+func (r *BGPConfigReconciler) namespacePending(o handler.MapObject) []reconcile.Request {
+	pending, err := r.pendingServices(context.Background(), client.InNamespace(o.Meta.GetName()))
+	if err != nil {
+		r.Log.Error(err, "list pending services error", "namespace", o.Meta.GetName())
+		return nil
+	}
+	reqs := make([]reconcile.Request, 0, len(pending))
+	for i := range pending {
+		reqs = append(reqs, reconcile.Request{NamespacedName: types.NamespacedName{
+			Namespace: pending[i].Namespace, Name: pending[i].Name}})
+	}
+	return reqs
+}
+
+// pendingServices returns the LoadBalancer services listed with opts which
+// are without all of their ips.
+func (r *BGPConfigReconciler) pendingServices(ctx context.Context, opts ...client.ListOption) ([]corev1.Service, error) {
+	svcs := &corev1.ServiceList{}
+	filterOptions := &client.ListOptions{Limit: listPageSize}
+	filterOptions.ApplyOptions(opts)
+	var pending []corev1.Service
+	for {
+		if err := r.List(ctx, svcs, filterOptions); err != nil {
+			return nil, err
+		}
+		for i := range svcs.Items {
+			if !validate.IsTypeLoadBalancer(&svcs.Items[i]) {
+				continue
+			}
+			raw, err := r.rawService(ctx, types.NamespacedName{Namespace: svcs.Items[i].Namespace, Name: svcs.Items[i].Name})
+			if err != nil {
+				if errors.IsNotFound(err) {
+					continue
+				}
+				return nil, err
+			}
+			if shortOfIPs(&svcs.Items[i], raw) {
+				pending = append(pending, svcs.Items[i])
+			}
+		}
+		if svcs.Continue == "" {
+			break
+		}
+		filterOptions.Continue = svcs.Continue
+		svcs.Continue = ""
+	}
+	return pending, nil
+}
+
+// shortOfIPs reports whether svc has fewer ips of one of its families than
+// it asks for. Services with invalid annotations or ip families are left to
+// their own reconcile, which reports them.
+func shortOfIPs(svc *corev1.Service, raw *unstructured.Unstructured) bool {
+	count, err := ipCount(svc)
+	if err != nil {
+		return false
+	}
+	families, _, err := util.ServiceIPFamilies(svc, raw)
+	if err != nil {
+		return false
+	}
+	for _, family := range families {
+		if len(ingressOfFamily(svc.Status.LoadBalancer.Ingress, family)) < count {
+			return true
+		}
+	}
+	return false
+}
+
+// DrainPool tells the services holding ips of pool, given as namespace/name,
+// that the pool is being removed, and requeues them when they are to be
+// migrated to other pools.
+func (r *BGPConfigReconciler) DrainPool(pool string, allocations map[string][]string) {
+	svcs := make([]corev1.Service, 0, len(allocations))
+	migrate := false
+	for ip, owners := range allocations {
+		migrate = migrate || r.IPAM.Migrating(ip)
+		for _, owner := range owners {
+			parts := strings.SplitN(owner, "/", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			svc := corev1.Service{}
+			svc.Namespace, svc.Name = parts[0], parts[1]
+			svcs = append(svcs, svc)
+			r.Recorder.Eventf(&svc, corev1.EventTypeWarning, "PoolDraining",
+				"ip %s belongs to pool %s which is being removed", ip, pool)
+		}
+	}
+	if migrate {
+		r.requeue(svcs)
+	}
+}
+
+// requeue reconciles svcs again. It never blocks.
+func (r *BGPConfigReconciler) requeue(svcs []corev1.Service) {
+	go func() {
+		for i := range svcs {
+			r.pending <- event.GenericEvent{Meta: &svcs[i], Object: &svcs[i]}
+		}
+	}()
+}
+
+// ingressOfFamily returns the ips of ingress of family.
+func ingressOfFamily(ingress []corev1.LoadBalancerIngress, family corev1.IPFamily) []string {
+	var ips []string
+	for _, item := range ingress {
+		if item.IP != "" && util.IPFamilyOf(item.IP) == family {
+			ips = append(ips, item.IP)
+		}
+	}
+	return ips
 }
 
 func (r *BGPConfigReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	p := predicate.Funcs{
 		DeleteFunc: func(e event.DeleteEvent) bool {
-			return false
+			return validate.IsTypeLoadBalancer(e.Object)
 		},
 		UpdateFunc: func(e event.UpdateEvent) bool {
 			return validate.IsTypeLoadBalancer(e.ObjectNew) || validate.IsTypeLoadBalancer(e.ObjectOld)
@@ -189,7 +745,28 @@ func (r *BGPConfigReconciler) SetupWithManager(mgr ctrl.Manager) error {
 			return validate.IsTypeLoadBalancer(e.Object) && !validate.IsAssignend(e.Object)
 		},
 	}
+	// Init creates the channel already when it requeues services.
+	if r.pending == nil {
+		r.pending = make(chan event.GenericEvent)
+	}
+	// Raising the quota of a namespace lets its pending services get
+	// their ips.
+	quotaChanged := predicate.Funcs{
+		CreateFunc:  func(event.CreateEvent) bool { return false },
+		DeleteFunc:  func(event.DeleteEvent) bool { return false },
+		GenericFunc: func(event.GenericEvent) bool { return false },
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			before, after := e.MetaOld.GetAnnotations(), e.MetaNew.GetAnnotations()
+			return before[ipQuotaAnnotation] != after[ipQuotaAnnotation] ||
+				before[poolQuotaAnnotation] != after[poolQuotaAnnotation]
+		},
+	}
 	return ctrl.NewControllerManagedBy(mgr).
-		For(&corev1.Service{}).WithEventFilter(p).
+		For(&corev1.Service{}, builder.WithPredicates(p)).
+		Watches(&source.Channel{Source: r.pending}, &handler.EnqueueRequestForObject{}).
+		Watches(&source.Kind{Type: &corev1.Namespace{}},
+			&handler.EnqueueRequestsFromMapFunc{ToRequests: handler.ToRequestsFunc(r.namespacePending)},
+			builder.WithPredicates(quotaChanged)).
+		WithOptions(controller.Options{MaxConcurrentReconciles: r.MaxConcurrentReconciles}).
 		Complete(r)
 }
@@ -0,0 +1,376 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/LambdaHJ/bgplb/api/v1beta1"
+	"github.com/LambdaHJ/bgplb/pkg/ipam"
+	"github.com/LambdaHJ/bgplb/pkg/util"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+)
+
+// newServiceReconciler returns a BGPConfigReconciler working on a fake
+// client holding objs and an ipam with the given pools.
+func newServiceReconciler(t *testing.T, pools []*ipam.Pool, objs ...runtime.Object) *BGPConfigReconciler {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := v1beta1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := v1beta1.CalicoAddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	im := ipam.NewIPAMManager(ipam.NewMemoryStore())
+	for _, p := range pools {
+		if err := im.AddPool(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := fake.NewFakeClientWithScheme(scheme, objs...)
+	return &BGPConfigReconciler{
+		Client:       c,
+		Log:          ctrl.Log.WithName("test"),
+		Scheme:       scheme,
+		IPAM:         im,
+		Recorder:     record.NewFakeRecorder(100),
+		ServiceCache: c,
+	}
+}
+
+// loadBalancer returns a LoadBalancer service of namespace/name.
+func loadBalancer(namespace, name string, annotations map[string]string) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Annotations: annotations},
+		Spec: corev1.ServiceSpec{
+			Type:  corev1.ServiceTypeLoadBalancer,
+			Ports: []corev1.ServicePort{{Protocol: corev1.ProtocolTCP, Port: 80}},
+		},
+	}
+}
+
+// ingressIPs returns the ips in the status of the service namespace/name.
+func ingressIPs(t *testing.T, c client.Client, namespace, name string) []string {
+	svc := &corev1.Service{}
+	if err := c.Get(context.Background(), types.NamespacedName{Namespace: namespace, Name: name}, svc); err != nil {
+		t.Fatal(err)
+	}
+	var ips []string
+	for _, ingress := range svc.Status.LoadBalancer.Ingress {
+		ips = append(ips, ingress.IP)
+	}
+	return ips
+}
+
+func TestPoolQuotaPerIP(t *testing.T) {
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name:        "team",
+		Annotations: map[string]string{poolQuotaAnnotation: "a=1"},
+	}}
+	svc := loadBalancer("team", "web", map[string]string{ipCountAnnotation: "2"})
+	r := newServiceReconciler(t, []*ipam.Pool{
+		{Name: "a", Cidr: "10.0.0.0/29"},
+		{Name: "b", Cidr: "10.0.1.0/29"},
+	}, ns, svc)
+
+	if _, err := r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "team", Name: "web"}}); err != nil {
+		t.Fatal(err)
+	}
+	ips := ingressIPs(t, r.Client, "team", "web")
+	if len(ips) != 2 {
+		t.Fatalf("expected two ips, got %v", ips)
+	}
+	// The quota of pool a is used up by the first ip.
+	if r.IPAM.PoolOf(ips[0]) != "a" || r.IPAM.PoolOf(ips[1]) != "b" {
+		t.Errorf("expected one ip of pool a and one of pool b, got %v", ips)
+	}
+	if usage := r.IPAM.NamespaceUsage("team"); usage["a"] != 1 || usage["b"] != 1 {
+		t.Errorf("unexpected usage %v", usage)
+	}
+}
+
+// dualStack creates a LoadBalancer service of namespace/name with
+// spec.ipFamilies and spec.ipFamilyPolicy, which the typed Service does not
+// have.
+func dualStack(t *testing.T, c client.Client, namespace, name string, families []interface{}, policy string) {
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(loadBalancer(namespace, name, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := &unstructured.Unstructured{Object: obj}
+	raw.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("Service"))
+	if err := unstructured.SetNestedSlice(raw.Object, families, "spec", "ipFamilies"); err != nil {
+		t.Fatal(err)
+	}
+	if err := unstructured.SetNestedField(raw.Object, policy, "spec", "ipFamilyPolicy"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Create(context.Background(), raw); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDualStack(t *testing.T) {
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}}
+	r := newServiceReconciler(t, []*ipam.Pool{
+		{Name: "v4", Cidr: "10.0.0.0/29"},
+		{Name: "v6", Cidr: "fd00::/125"},
+	}, ns)
+	dualStack(t, r.Client, "default", "web", []interface{}{"IPv6", "IPv4"}, util.IPFamilyPolicyRequireDualStack)
+
+	if _, err := r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "web"}}); err != nil {
+		t.Fatal(err)
+	}
+	ips := ingressIPs(t, r.Client, "default", "web")
+	if len(ips) != 2 || r.IPAM.PoolOf(ips[0]) != "v6" || r.IPAM.PoolOf(ips[1]) != "v4" {
+		t.Errorf("expected an IPv6 then an IPv4 ip, got %v", ips)
+	}
+}
+
+func TestUnknownIPFamily(t *testing.T) {
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}}
+	r := newServiceReconciler(t, []*ipam.Pool{{Name: "v4", Cidr: "10.0.0.0/29"}}, ns)
+	recorder := record.NewFakeRecorder(10)
+	r.Recorder = recorder
+	dualStack(t, r.Client, "default", "typo", []interface{}{"IPv5"}, util.IPFamilyPolicySingleStack)
+	dualStack(t, r.Client, "default", "policy", []interface{}{"IPv4"}, "DualStack")
+
+	for _, name := range []string{"typo", "policy"} {
+		if _, err := r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: name}}); err == nil {
+			t.Errorf("expected %s to be rejected", name)
+		}
+		if ips := ingressIPs(t, r.Client, "default", name); len(ips) != 0 {
+			t.Errorf("expected no ip for %s, got %v", name, ips)
+		}
+		if event := <-recorder.Events; !strings.Contains(event, "InvalidIPFamilies") {
+			t.Errorf("unexpected event %q", event)
+		}
+	}
+}
+
+func TestRequeuePendingPerFamily(t *testing.T) {
+	// Both services hold an IPv4 ip only.
+	dual := loadBalancer("default", "dual", nil)
+	dual.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{IP: "10.0.0.2"}}
+	single := loadBalancer("default", "single", nil)
+	single.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{IP: "10.0.0.3"}}
+	r := newServiceReconciler(t, nil, dual, single)
+	r.pending = make(chan event.GenericEvent)
+	// The cache serves them with their ip families.
+	cache := fake.NewFakeClientWithScheme(r.Scheme)
+	r.ServiceCache = cache
+	dualStack(t, cache, "default", "dual", []interface{}{"IPv4", "IPv6"}, util.IPFamilyPolicyPreferDualStack)
+	dualStack(t, cache, "default", "single", []interface{}{"IPv4"}, util.IPFamilyPolicySingleStack)
+
+	if err := r.RequeuePending(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-r.pending:
+		if e.Meta.GetName() != "dual" {
+			t.Errorf("expected the dual-stack service short of an IPv6 ip to be requeued, got %s", e.Meta.GetName())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the dual-stack service to be requeued")
+	}
+	select {
+	case e := <-r.pending:
+		t.Errorf("unexpected requeue of %s", e.Meta.GetName())
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestSharedJoinTakesNoQuota(t *testing.T) {
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name:        "team",
+		Annotations: map[string]string{ipQuotaAnnotation: "1"},
+	}}
+	shared := map[string]string{sharingKeyAnnotation: "web"}
+	https := loadBalancer("team", "https", shared)
+	https.Spec.Ports[0].Port = 443
+	r := newServiceReconciler(t, []*ipam.Pool{{Name: "a", Cidr: "10.0.0.0/29"}},
+		ns, loadBalancer("team", "http", shared), https)
+
+	for _, name := range []string{"http", "https"} {
+		if _, err := r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "team", Name: name}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	httpIPs, httpsIPs := ingressIPs(t, r.Client, "team", "http"), ingressIPs(t, r.Client, "team", "https")
+	if len(httpIPs) != 1 || len(httpsIPs) != 1 || httpIPs[0] != httpsIPs[0] {
+		t.Fatalf("expected both services to share one ip, got %v and %v", httpIPs, httpsIPs)
+	}
+	if usage := r.IPAM.NamespaceUsage("team"); usage["a"] != 1 {
+		t.Errorf("expected the shared ip to be counted once, got %v", usage)
+	}
+	// With the quota used up, an ip nobody holds is still refused.
+	other := loadBalancer("team", "other", map[string]string{sharingKeyAnnotation: "other"})
+	if err := r.Create(context.Background(), other); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "team", Name: "other"}}); err != nil {
+		t.Fatal(err)
+	}
+	if ips := ingressIPs(t, r.Client, "team", "other"); len(ips) != 0 {
+		t.Errorf("expected no ip beyond the quota, got %v", ips)
+	}
+}
+
+func TestReleaseRequeuesQuotaExceeded(t *testing.T) {
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name:        "team",
+		Annotations: map[string]string{ipQuotaAnnotation: "1"},
+	}}
+	r := newServiceReconciler(t, []*ipam.Pool{{Name: "a", Cidr: "10.0.0.0/29"}},
+		ns, loadBalancer("team", "first", nil), loadBalancer("team", "second", nil))
+	r.pending = make(chan event.GenericEvent)
+
+	for _, name := range []string{"first", "second"} {
+		if _, err := r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "team", Name: name}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ips := ingressIPs(t, r.Client, "team", "second"); len(ips) != 0 {
+		t.Fatalf("expected the second service to exceed the quota, got %v", ips)
+	}
+	// A quota change maps the namespace to its pending service.
+	reqs := r.namespacePending(handler.MapObject{Meta: ns, Object: ns})
+	if len(reqs) != 1 || reqs[0].Name != "second" {
+		t.Errorf("expected the second service to be mapped, got %v", reqs)
+	}
+
+	first := &corev1.Service{}
+	if err := r.Get(context.Background(), types.NamespacedName{Namespace: "team", Name: "first"}, first); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Delete(context.Background(), first); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "team", Name: "first"}}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-r.pending:
+		if e.Meta.GetName() != "second" {
+			t.Errorf("expected the second service to be requeued, got %s", e.Meta.GetName())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the second service to be requeued once the quota is freed")
+	}
+}
+
+func TestStatusWipedAtQuota(t *testing.T) {
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name:        "team",
+		Annotations: map[string]string{ipQuotaAnnotation: "1"},
+	}}
+	r := newServiceReconciler(t, []*ipam.Pool{{Name: "a", Cidr: "10.0.0.0/29"}}, ns, loadBalancer("team", "web", nil))
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "team", Name: "web"}}
+
+	if _, err := r.Reconcile(req); err != nil {
+		t.Fatal(err)
+	}
+	ips := ingressIPs(t, r.Client, "team", "web")
+	if len(ips) != 1 {
+		t.Fatalf("expected one ip, got %v", ips)
+	}
+	svc := &corev1.Service{}
+	if err := r.Get(context.Background(), req.NamespacedName, svc); err != nil {
+		t.Fatal(err)
+	}
+	svc.Status.LoadBalancer.Ingress = nil
+	if err := r.Status().Update(context.Background(), svc); err != nil {
+		t.Fatal(err)
+	}
+
+	// The ip the ipam still holds for the service takes no more quota.
+	result, err := r.Reconcile(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ingressIPs(t, r.Client, "team", "web"); len(got) != 1 || got[0] != ips[0] {
+		t.Errorf("expected %v back, got %v", ips, got)
+	}
+	if result.RequeueAfter != 0 {
+		t.Errorf("unexpected requeue after %v", result.RequeueAfter)
+	}
+	if usage := r.IPAM.NamespaceUsage("team"); usage["a"] != 1 {
+		t.Errorf("unexpected usage %v", usage)
+	}
+}
+
+func TestUnavailablePool(t *testing.T) {
+	missing := map[string]string{poolAnnotation: "missing"}
+	// The service was a LoadBalancer of pool a before.
+	internal := loadBalancer("default", "internal", missing)
+	internal.Spec.Type = corev1.ServiceTypeClusterIP
+	internal.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{IP: "10.0.0.2"}}
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}}
+	r := newServiceReconciler(t, []*ipam.Pool{{Name: "a", Cidr: "10.0.0.0/29"}},
+		ns, internal, loadBalancer("default", "web", missing))
+	if !r.IPAM.AddUsedIP("10.0.0.2", &ipam.Request{Owner: "default/internal"}) {
+		t.Fatal("expected to restore 10.0.0.2")
+	}
+	recorder := r.Recorder.(*record.FakeRecorder)
+
+	if _, err := r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "internal"}}); err != nil {
+		t.Fatal(err)
+	}
+	if holders := r.IPAM.Holders("10.0.0.2"); holders != nil {
+		t.Errorf("expected 10.0.0.2 to be released, got %v", holders)
+	}
+	if ips := ingressIPs(t, r.Client, "default", "internal"); len(ips) != 0 {
+		t.Errorf("expected no ip left, got %v", ips)
+	}
+
+	result, err := r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "web"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Requeue || result.RequeueAfter != 0 {
+		t.Errorf("unexpected requeue %+v", result)
+	}
+	select {
+	case event := <-recorder.Events:
+		if !strings.Contains(event, "PoolUnavailable") {
+			t.Errorf("unexpected event %q", event)
+		}
+	default:
+		t.Error("expected a PoolUnavailable event")
+	}
+	if ips := ingressIPs(t, r.Client, "default", "web"); len(ips) != 0 {
+		t.Errorf("expected no ip, got %v", ips)
+	}
+}
@@ -0,0 +1,316 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/LambdaHJ/bgplb/api/v1beta1"
+	"github.com/LambdaHJ/bgplb/pkg/ipam"
+	"github.com/LambdaHJ/bgplb/pkg/util"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// BGPIPsConfigReconciler keeps the pools of the ipam in sync with the
+// BGPIPsConfig objects and reports their utilization in the status.
+type BGPIPsConfigReconciler struct {
+	client.Client
+	Log      logr.Logger
+	Scheme   *runtime.Scheme
+	IPAM     *ipam.IPAMManager
+	Recorder record.EventRecorder
+	// Services are told when their pool is being removed, and requeued when
+	// a pool is added or grows.
+	Services *BGPConfigReconciler
+	// PoolNamespace is the namespace of the BGPIPsConfigs, the ones of other
+	// namespaces are ignored.
+	PoolNamespace string
+
+	// changes requeues the pools whose allocations changed, notified
+	// coalesces the notifications.
+	changes  chan event.GenericEvent
+	notified poolChanges
+}
+
+// +kubebuilder:rbac:groups=lb.lambdahj.site,resources=bgpipsconfigs,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=lb.lambdahj.site,resources=bgpipsconfigs/status,verbs=get;update;patch
+
+func (r *BGPIPsConfigReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
+	ctx := context.Background()
+	reqLog := r.Log.WithValues("bgpipsconfig", req.NamespacedName)
+
+	conf := &v1beta1.BGPIPsConfig{}
+	err := r.Get(ctx, req.NamespacedName, conf)
+	if req.Namespace != r.PoolNamespace {
+		if err == nil && conf.DeletionTimestamp == nil {
+			r.Recorder.Eventf(conf, corev1.EventTypeWarning, "IgnoredNamespace",
+				"pools are only read from namespace %s", r.PoolNamespace)
+		}
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	if err != nil {
+		if errors.IsNotFound(err) {
+			// Pools of the Calico BGPConfiguration have no BGPIPsConfig
+			// unless the crd store creates one, their utilization is
+			// reported on one created for them.
+			if r.IPAM.IsCalicoPool(req.Name) {
+				return ctrl.Result{}, r.createCalicoConfig(ctx, req.Name)
+			}
+			if err := r.IPAM.RemovePool(req.Name); err != nil {
+				reqLog.Error(err, "remove pool error")
+			}
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, err
+	}
+
+	// The BGPIPsConfig of a Calico pool only reports its utilization and
+	// goes away with the cidr, it never describes a pool of its own.
+	if ipam.IsCalicoConfig(conf) {
+		if r.IPAM.IsCalicoPool(conf.Name) {
+			return ctrl.Result{}, r.updateStatus(ctx, conf)
+		}
+		if util.ContainsString(conf.Finalizers, finalizer) {
+			controllerutil.RemoveFinalizer(conf, finalizer)
+			if err := r.Update(ctx, conf); err != nil {
+				return ctrl.Result{}, client.IgnoreNotFound(err)
+			}
+		}
+		if conf.DeletionTimestamp != nil {
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, client.IgnoreNotFound(r.Delete(ctx, conf))
+	}
+
+	if util.IsDeletionCandidate(conf, finalizer) {
+		return ctrl.Result{}, r.drain(ctx, conf)
+	}
+	if conf.DeletionTimestamp != nil {
+		return ctrl.Result{}, nil
+	}
+	// The finalizer keeps a deleted pool around until it is drained, Calico
+	// pools are removed through the BGPConfiguration instead.
+	if util.NeedToAddFinalizer(conf, finalizer) && !r.IPAM.IsCalicoPool(conf.Name) {
+		controllerutil.AddFinalizer(conf, finalizer)
+		if err := r.Update(ctx, conf); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	before := r.IPAM.Status(conf.Name)
+	pool, err := ipam.PoolFromConfig(conf)
+	if err == nil {
+		err = r.IPAM.UpdatePool(pool)
+	}
+	if err != nil {
+		reqLog.Error(err, "invalid pool")
+		return ctrl.Result{}, r.invalidStatus(ctx, conf, err)
+	}
+	// Services waiting for an ip may get one from a new or larger pool.
+	if after := r.IPAM.Status(conf.Name); after != nil && (before == nil || after.Total > before.Total) {
+		if err := r.Services.RequeuePending(ctx); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	return ctrl.Result{}, r.updateStatus(ctx, conf)
+}
+
+// drain removes the pool of the deleted conf, or starts draining it while
+// services still hold its ips. The finalizer is dropped once the pool is gone.
+func (r *BGPIPsConfigReconciler) drain(ctx context.Context, conf *v1beta1.BGPIPsConfig) error {
+	before := r.IPAM.Status(conf.Name)
+	err := r.IPAM.RemovePool(conf.Name)
+	if err == ipam.ErrPoolInUse {
+		if before != nil && !before.Draining {
+			r.Log.Info("drain pool", "pool", conf.Name)
+			r.Services.DrainPool(conf.Name, before.Allocations)
+		}
+		return r.updateStatus(ctx, conf)
+	}
+	if err != nil {
+		return err
+	}
+	controllerutil.RemoveFinalizer(conf, finalizer)
+	return r.Update(ctx, conf)
+}
+
+// createCalicoConfig creates the BGPIPsConfig reporting the utilization of
+// the Calico pool name.
+func (r *BGPIPsConfigReconciler) createCalicoConfig(ctx context.Context, name string) error {
+	for _, p := range r.IPAM.CalicoPools() {
+		if p.Name != name {
+			continue
+		}
+		conf := &v1beta1.BGPIPsConfig{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: r.PoolNamespace,
+				Labels:    map[string]string{ipam.CalicoPoolLabel: "true"},
+			},
+			Spec: v1beta1.BGPIPsConfigSpec{Cidr: p.Cidr},
+		}
+		if err := r.Create(ctx, conf); err != nil && !errors.IsAlreadyExists(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateStatus reports the utilization of the pool of conf.
+func (r *BGPIPsConfigReconciler) updateStatus(ctx context.Context, conf *v1beta1.BGPIPsConfig) error {
+	status := r.poolStatus(conf)
+	if status == nil {
+		return nil
+	}
+	return r.setStatus(ctx, conf, *status)
+}
+
+// poolStatus returns the utilization of the pool of conf, or nil if the
+// ipam has no such pool.
+func (r *BGPIPsConfigReconciler) poolStatus(conf *v1beta1.BGPIPsConfig) *v1beta1.BGPIPsConfigStatus {
+	poolStatus := r.IPAM.Status(conf.Name)
+	if poolStatus == nil {
+		return nil
+	}
+	status := &v1beta1.BGPIPsConfigStatus{
+		Total:       poolStatus.Total,
+		Used:        poolStatus.Used,
+		Free:        poolStatus.Free,
+		Allocations: make([]v1beta1.IPAllocation, 0, len(poolStatus.Allocations)),
+	}
+	for ip, owners := range poolStatus.Allocations {
+		status.Allocations = append(status.Allocations, v1beta1.IPAllocation{IP: ip, Services: owners})
+	}
+	sort.Slice(status.Allocations, func(i, j int) bool {
+		return status.Allocations[i].IP < status.Allocations[j].IP
+	})
+	if len(status.Allocations) == 0 {
+		status.Allocations = nil
+	}
+
+	if poolStatus.Draining {
+		status.Conditions = append(status.Conditions, drainingCondition(conf, poolStatus))
+	}
+	if len(poolStatus.Conflicts) > 0 {
+		status.Conditions = append(status.Conditions, newCondition(conf.Status.Conditions, v1beta1.PoolConditionConflicting,
+			"OverlapsCluster", "addresses not handed out: "+strings.Join(poolStatus.Conflicts, ", ")))
+	}
+	return status
+}
+
+// invalidStatus reports why conf cannot be applied to its pool. A pool
+// which still serves its previous definition keeps reporting its
+// utilization next to the condition.
+func (r *BGPIPsConfigReconciler) invalidStatus(ctx context.Context, conf *v1beta1.BGPIPsConfig, cause error) error {
+	cond := newCondition(conf.Status.Conditions, v1beta1.PoolConditionInvalid, "InvalidPool", cause.Error())
+	reported := false
+	for _, c := range conf.Status.Conditions {
+		reported = reported || c == cond
+	}
+	if !reported {
+		r.Recorder.Event(conf, corev1.EventTypeWarning, "InvalidPool", cause.Error())
+	}
+	status := r.poolStatus(conf)
+	if status == nil {
+		status = &v1beta1.BGPIPsConfigStatus{}
+	}
+	status.Conditions = append(status.Conditions, cond)
+	return r.setStatus(ctx, conf, *status)
+}
+
+// setStatus updates the status of conf to status unless nothing changed.
+func (r *BGPIPsConfigReconciler) setStatus(ctx context.Context, conf *v1beta1.BGPIPsConfig, status v1beta1.BGPIPsConfigStatus) error {
+	status.LastUpdated = conf.Status.LastUpdated
+	if equality.Semantic.DeepEqual(status, conf.Status) {
+		return nil
+	}
+	now := metav1.Now()
+	status.LastUpdated = &now
+	conf.Status = status
+	return r.Status().Update(ctx, conf)
+}
+
+// drainingCondition lists the services keeping the pool of conf from being
+// removed.
+func drainingCondition(conf *v1beta1.BGPIPsConfig, poolStatus *ipam.PoolStatus) v1beta1.PoolCondition {
+	var owners []string
+	for _, holders := range poolStatus.Allocations {
+		for _, owner := range holders {
+			if !util.ContainsString(owners, owner) {
+				owners = append(owners, owner)
+			}
+		}
+	}
+	sort.Strings(owners)
+	return newCondition(conf.Status.Conditions, v1beta1.PoolConditionDraining, "InUse",
+		"waiting for services to release their ips: "+strings.Join(owners, ", "))
+}
+
+// newCondition returns a true condition of type t, keeping the transition
+// time of existing when the condition already holds.
+func newCondition(existing []v1beta1.PoolCondition, t, reason, message string) v1beta1.PoolCondition {
+	cond := v1beta1.PoolCondition{
+		Type:               t,
+		Status:             corev1.ConditionTrue,
+		LastTransitionTime: metav1.Now(),
+		Reason:             reason,
+		Message:            message,
+	}
+	for _, c := range existing {
+		if c.Type == cond.Type && c.Status == cond.Status {
+			cond.LastTransitionTime = c.LastTransitionTime
+		}
+	}
+	return cond
+}
+
+// NotifyPoolChange requeues the BGPIPsConfig of pool so that its status is
+// refreshed. It never blocks, which lets it be used as ipam.IPAMManager.OnChange,
+// and may be called before SetupWithManager.
+func (r *BGPIPsConfigReconciler) NotifyPoolChange(pool string) {
+	r.notified.notify(pool)
+}
+
+func (r *BGPIPsConfigReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	r.changes = make(chan event.GenericEvent)
+	r.notified.start(func(pool string) {
+		conf := &v1beta1.BGPIPsConfig{}
+		conf.Name = pool
+		conf.Namespace = r.PoolNamespace
+		r.changes <- event.GenericEvent{Meta: conf, Object: conf}
+	})
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&v1beta1.BGPIPsConfig{}).
+		Watches(&source.Channel{Source: r.changes}, &handler.EnqueueRequestForObject{}).
+		Complete(r)
+}
@@ -0,0 +1,301 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/LambdaHJ/bgplb/api/v1beta1"
+	"github.com/LambdaHJ/bgplb/pkg/ipam"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+func TestCalicoPoolStatus(t *testing.T) {
+	services := newServiceReconciler(t, nil)
+	cidr := "10.0.1.0/29"
+	if err := services.IPAM.NewCidr(cidr); err != nil {
+		t.Fatal(err)
+	}
+	if !services.IPAM.AcquireSpecificIP("10.0.1.2", &ipam.Request{Owner: "default/web"}) {
+		t.Fatal("expected to acquire 10.0.1.2")
+	}
+	r := &BGPIPsConfigReconciler{
+		Client:        services.Client,
+		Log:           ctrl.Log.WithName("test"),
+		Scheme:        services.Scheme,
+		IPAM:          services.IPAM,
+		Recorder:      services.Recorder,
+		Services:      services,
+		PoolNamespace: "bgplb-system",
+	}
+	key := types.NamespacedName{Namespace: "bgplb-system", Name: ipam.PoolName(cidr)}
+	reconcile := func() *v1beta1.BGPIPsConfig {
+		if _, err := r.Reconcile(ctrl.Request{NamespacedName: key}); err != nil {
+			t.Fatal(err)
+		}
+		conf := &v1beta1.BGPIPsConfig{}
+		if err := r.Get(context.Background(), key, conf); err != nil {
+			if errors.IsNotFound(err) {
+				return nil
+			}
+			t.Fatal(err)
+		}
+		return conf
+	}
+
+	// The memory store creates no BGPIPsConfig, one is created to report
+	// the utilization of the pool.
+	conf := reconcile()
+	if conf == nil || conf.Labels[ipam.CalicoPoolLabel] != "true" || conf.Spec.Cidr != cidr {
+		t.Fatalf("expected a BGPIPsConfig for the Calico pool, got %+v", conf)
+	}
+	conf = reconcile()
+	if conf.Status.Total != 6 || conf.Status.Used != 1 || len(conf.Status.Allocations) != 1 {
+		t.Errorf("expected 6 total and 10.0.1.2 used, got %+v", conf.Status)
+	}
+	if len(conf.Finalizers) != 0 {
+		t.Errorf("expected no finalizer, got %v", conf.Finalizers)
+	}
+
+	// It goes away with the cidr.
+	if err := services.IPAM.ReleaseIP("10.0.1.2", "default/web"); err != nil {
+		t.Fatal(err)
+	}
+	if err := services.IPAM.RemovePool(key.Name); err != nil {
+		t.Fatal(err)
+	}
+	if conf := reconcile(); conf != nil {
+		t.Errorf("expected the BGPIPsConfig of the removed pool to be deleted, got %+v", conf)
+	}
+}
+
+func TestRemovedCalicoPoolWithCRDStore(t *testing.T) {
+	cidr := "10.0.1.0/29"
+	services := newServiceReconciler(t, nil)
+	services.IPAM = ipam.NewIPAMManager(ipam.NewCRDStore(services.Client, services.Client, "bgplb-system"))
+	r := &BGPIPsConfigReconciler{
+		Client:        services.Client,
+		Log:           ctrl.Log.WithName("test"),
+		Scheme:        services.Scheme,
+		IPAM:          services.IPAM,
+		Recorder:      services.Recorder,
+		Services:      services,
+		PoolNamespace: "bgplb-system",
+	}
+	key := types.NamespacedName{Namespace: "bgplb-system", Name: ipam.PoolName(cidr)}
+
+	if err := r.IPAM.NewCidr(cidr); err != nil {
+		t.Fatal(err)
+	}
+	ip, err := r.IPAM.AcquireIP(&ipam.Request{Owner: "default/web"}, corev1.IPv4Protocol)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.IPAM.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	conf := &v1beta1.BGPIPsConfig{}
+	if err := r.Get(context.Background(), key, conf); err != nil {
+		t.Fatal(err)
+	}
+	if conf.Labels[ipam.CalicoPoolLabel] != "true" {
+		t.Errorf("expected the BGPIPsConfig of the Calico pool to be labeled, got %v", conf.Labels)
+	}
+
+	// The cidr is removed from the BGPConfiguration.
+	if err := r.IPAM.ReleaseIP(ip, "default/web"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.IPAM.RemovePool(key.Name); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.IPAM.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Get(context.Background(), key, conf); !errors.IsNotFound(err) {
+		t.Errorf("expected the BGPIPsConfig to be deleted, got %v", err)
+	}
+	if _, err := r.Reconcile(ctrl.Request{NamespacedName: key}); err != nil {
+		t.Fatal(err)
+	}
+	if ip, err := r.IPAM.AcquireIP(&ipam.Request{Owner: "default/other"}, corev1.IPv4Protocol); err == nil {
+		t.Errorf("expected no ip once the cidr is gone, got %s", ip)
+	}
+}
+
+func TestPoolNamedAfterCidr(t *testing.T) {
+	cidr := "10.0.1.0/29"
+	// Only the label tells the BGPIPsConfigs of Calico pools apart.
+	conf := &v1beta1.BGPIPsConfig{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "bgplb-system", Name: ipam.PoolName(cidr)},
+		Spec:       v1beta1.BGPIPsConfigSpec{Cidr: cidr},
+	}
+	services := newServiceReconciler(t, nil, conf)
+	services.PoolNamespace = "bgplb-system"
+	if err := services.LoadPools(services.Client); err != nil {
+		t.Fatal(err)
+	}
+	if !services.IPAM.HasPool(conf.Name) || services.IPAM.IsCalicoPool(conf.Name) {
+		t.Fatal("expected the BGPIPsConfig to be added as a pool of its own")
+	}
+	r := &BGPIPsConfigReconciler{
+		Client:        services.Client,
+		Log:           ctrl.Log.WithName("test"),
+		Scheme:        services.Scheme,
+		IPAM:          services.IPAM,
+		Recorder:      services.Recorder,
+		Services:      services,
+		PoolNamespace: "bgplb-system",
+	}
+	key := types.NamespacedName{Namespace: "bgplb-system", Name: conf.Name}
+	if _, err := r.Reconcile(ctrl.Request{NamespacedName: key}); err != nil {
+		t.Fatal(err)
+	}
+	if !services.IPAM.HasPool(conf.Name) {
+		t.Error("expected the pool to be kept")
+	}
+	if err := r.Get(context.Background(), key, conf); err != nil {
+		t.Errorf("expected the BGPIPsConfig to be kept, got %v", err)
+	}
+}
+
+func TestNewPoolRequeuesPending(t *testing.T) {
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}}
+	conf := &v1beta1.BGPIPsConfig{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "bgplb-system", Name: "a"},
+		Spec:       v1beta1.BGPIPsConfigSpec{Cidr: "10.0.0.0/30"},
+	}
+	services := newServiceReconciler(t, nil, ns, conf, loadBalancer("default", "web", nil))
+	services.pending = make(chan event.GenericEvent)
+	recorder := record.NewFakeRecorder(10)
+	services.Recorder = recorder
+	svcKey := types.NamespacedName{Namespace: "default", Name: "web"}
+
+	// Without a pool the service is retried later.
+	result, err := services.Reconcile(ctrl.Request{NamespacedName: svcKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.RequeueAfter == 0 {
+		t.Error("expected the service without an ip to be retried")
+	}
+	if event := <-recorder.Events; !strings.Contains(event, "AcquireIPFailed") {
+		t.Errorf("unexpected event %q", event)
+	}
+
+	r := &BGPIPsConfigReconciler{
+		Client:        services.Client,
+		Log:           ctrl.Log.WithName("test"),
+		Scheme:        services.Scheme,
+		IPAM:          services.IPAM,
+		Recorder:      services.Recorder,
+		Services:      services,
+		PoolNamespace: "bgplb-system",
+	}
+	reconcile := func() {
+		if _, err := r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "bgplb-system", Name: "a"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectRequeue := func(when string) {
+		select {
+		case e := <-services.pending:
+			if e.Meta.GetNamespace() != svcKey.Namespace || e.Meta.GetName() != svcKey.Name {
+				t.Errorf("%s: unexpected requeue of %s/%s", when, e.Meta.GetNamespace(), e.Meta.GetName())
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: expected the pending service to be requeued", when)
+		}
+	}
+
+	reconcile()
+	expectRequeue("new pool")
+
+	// The pool grows while the service still waits.
+	if err := r.Get(context.Background(), types.NamespacedName{Namespace: "bgplb-system", Name: "a"}, conf); err != nil {
+		t.Fatal(err)
+	}
+	conf.Spec.Cidr = "10.0.0.0/29"
+	if err := r.Update(context.Background(), conf); err != nil {
+		t.Fatal(err)
+	}
+	reconcile()
+	expectRequeue("larger pool")
+
+	// Nothing changed, nobody is requeued.
+	reconcile()
+	select {
+	case e := <-services.pending:
+		t.Errorf("unexpected requeue of %s/%s", e.Meta.GetNamespace(), e.Meta.GetName())
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestInvalidCidrChangeKeepsStatus(t *testing.T) {
+	conf := &v1beta1.BGPIPsConfig{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "bgplb-system", Name: "a"},
+		Spec:       v1beta1.BGPIPsConfigSpec{Cidr: "10.0.0.0/29"},
+	}
+	services := newServiceReconciler(t, nil, conf)
+	r := &BGPIPsConfigReconciler{
+		Client:        services.Client,
+		Log:           ctrl.Log.WithName("test"),
+		Scheme:        services.Scheme,
+		IPAM:          services.IPAM,
+		Recorder:      services.Recorder,
+		Services:      services,
+		PoolNamespace: "bgplb-system",
+	}
+	key := types.NamespacedName{Namespace: "bgplb-system", Name: "a"}
+	reconcile := func() *v1beta1.BGPIPsConfig {
+		if _, err := r.Reconcile(ctrl.Request{NamespacedName: key}); err != nil {
+			t.Fatal(err)
+		}
+		conf := &v1beta1.BGPIPsConfig{}
+		if err := r.Get(context.Background(), key, conf); err != nil {
+			t.Fatal(err)
+		}
+		return conf
+	}
+
+	conf = reconcile()
+	if !services.IPAM.AcquireSpecificIP("10.0.0.2", &ipam.Request{Owner: "default/web"}) {
+		t.Fatal("expected to acquire 10.0.0.2")
+	}
+	// The cidr of a pool in use cannot change, it keeps serving the old one.
+	conf.Spec.Cidr = "10.0.1.0/29"
+	if err := r.Update(context.Background(), conf); err != nil {
+		t.Fatal(err)
+	}
+	conf = reconcile()
+	if conf.Status.Total != 6 || conf.Status.Used != 1 || len(conf.Status.Allocations) != 1 {
+		t.Errorf("expected the utilization of the old cidr to be kept, got %+v", conf.Status)
+	}
+	if len(conf.Status.Conditions) != 1 || conf.Status.Conditions[0].Type != v1beta1.PoolConditionInvalid {
+		t.Errorf("expected an Invalid condition, got %+v", conf.Status.Conditions)
+	}
+}
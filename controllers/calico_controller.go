@@ -0,0 +1,122 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"github.com/LambdaHJ/bgplb/api/v1beta1"
+	"github.com/LambdaHJ/bgplb/pkg/ipam"
+
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// calicoConfigName is the BGPConfiguration holding the cluster wide
+// serviceExternalIPs.
+const calicoConfigName = "default"
+
+// CalicoConfigReconciler keeps a pool for every cidr of the Calico
+// BGPConfiguration serviceExternalIPs, pools of removed cidrs are drained.
+type CalicoConfigReconciler struct {
+	client.Client
+	Log    logr.Logger
+	Scheme *runtime.Scheme
+	IPAM   *ipam.IPAMManager
+	// Services are requeued when a pool is added, so that services waiting
+	// for an ip get one.
+	Services *BGPConfigReconciler
+}
+
+func (r *CalicoConfigReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
+	ctx := context.Background()
+	reqLog := r.Log.WithValues("bgpconfiguration", req.NamespacedName)
+
+	if req.Name != calicoConfigName {
+		return ctrl.Result{}, nil
+	}
+	// Without the BGPConfiguration Calico advertises no cidr, its pools
+	// drain like removed cidrs.
+	bgpConf := &v1beta1.BGPConfiguration{}
+	if err := r.Get(ctx, req.NamespacedName, bgpConf); err != nil && !errors.IsNotFound(err) {
+		return ctrl.Result{}, err
+	}
+
+	added := false
+	listed := make(map[string]bool)
+	for _, cidr := range bgpConf.Spec.ServiceExternalIPs {
+		listed[cidr.Cidr] = true
+		exists := r.IPAM.HasPool(ipam.PoolName(cidr.Cidr))
+		// NewCidr also puts back a draining pool.
+		if err := r.IPAM.NewCidr(cidr.Cidr); err != nil {
+			reqLog.Error(err, "creat cidr error", "cidr", cidr.Cidr)
+			continue
+		}
+		if !exists {
+			reqLog.Info("add cidr", "cidr", cidr.Cidr)
+			added = true
+		}
+	}
+
+	// Cidrs gone from the BGPConfiguration drain until their last ip is
+	// released.
+	for _, pool := range r.IPAM.CalicoPools() {
+		if listed[pool.Cidr] {
+			continue
+		}
+		before := r.IPAM.Status(pool.Name)
+		err := r.IPAM.RemovePool(pool.Name)
+		switch {
+		case err == ipam.ErrPoolInUse:
+			if before != nil && !before.Draining {
+				reqLog.Info("drain cidr", "cidr", pool.Cidr)
+				r.Services.DrainPool(pool.Name, before.Allocations)
+			}
+		case err != nil:
+			reqLog.Error(err, "remove cidr error", "cidr", pool.Cidr)
+		default:
+			reqLog.Info("remove cidr", "cidr", pool.Cidr)
+		}
+	}
+
+	if !added {
+		return ctrl.Result{}, nil
+	}
+
+	return ctrl.Result{}, r.Services.RequeuePending(ctx)
+}
+
+func (r *CalicoConfigReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	// The pools restored for cidrs removed while the manager was down drain
+	// even if there is no BGPConfiguration to be reconciled.
+	start := make(chan event.GenericEvent)
+	go func() {
+		conf := &v1beta1.BGPConfiguration{}
+		conf.Name = calicoConfigName
+		start <- event.GenericEvent{Meta: conf, Object: conf}
+	}()
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&v1beta1.BGPConfiguration{}).
+		Watches(&source.Channel{Source: start}, &handler.EnqueueRequestForObject{}).
+		Complete(r)
+}
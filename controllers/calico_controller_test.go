@@ -0,0 +1,114 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+
+	"github.com/LambdaHJ/bgplb/api/v1beta1"
+	"github.com/LambdaHJ/bgplb/pkg/ipam"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// newCalicoReconciler returns a CalicoConfigReconciler working on a fake
+// client holding objs and an ipam with the Calico cidrs.
+func newCalicoReconciler(t *testing.T, cidrs []string, objs ...runtime.Object) *CalicoConfigReconciler {
+	services := newServiceReconciler(t, nil, objs...)
+	for _, cidr := range cidrs {
+		if err := services.IPAM.NewCidr(cidr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &CalicoConfigReconciler{
+		Client:   services.Client,
+		Log:      ctrl.Log.WithName("test"),
+		Scheme:   services.Scheme,
+		IPAM:     services.IPAM,
+		Services: services,
+	}
+}
+
+func reconcileCalico(t *testing.T, r *CalicoConfigReconciler) {
+	if _, err := r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Name: calicoConfigName}}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCalicoConfigNotFound(t *testing.T) {
+	r := newCalicoReconciler(t, []string{"10.0.1.0/29", "10.0.2.0/29"})
+	if !r.IPAM.AcquireSpecificIP("10.0.1.2", &ipam.Request{Owner: "default/web"}) {
+		t.Fatal("expected to acquire 10.0.1.2")
+	}
+
+	// Without a BGPConfiguration Calico advertises none of the cidrs.
+	reconcileCalico(t, r)
+	if r.IPAM.HasPool(ipam.PoolName("10.0.2.0/29")) {
+		t.Error("expected the unused pool to be removed")
+	}
+	if status := r.IPAM.Status(ipam.PoolName("10.0.1.0/29")); status == nil || !status.Draining {
+		t.Errorf("expected the pool in use to drain, got %+v", status)
+	}
+	if ip, err := r.IPAM.AcquireIP(&ipam.Request{Owner: "default/other"}, corev1.IPv4Protocol); err == nil {
+		t.Errorf("expected no ip from draining pools, got %s", ip)
+	}
+}
+
+func TestCalicoCidrRemovedWhileDown(t *testing.T) {
+	calicoConfig := func(cidr string, items ...v1beta1.IPItem) *v1beta1.BGPIPsConfig {
+		return &v1beta1.BGPIPsConfig{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "bgplb-system",
+				Name:      ipam.PoolName(cidr),
+				Labels:    map[string]string{ipam.CalicoPoolLabel: "true"},
+			},
+			Spec: v1beta1.BGPIPsConfigSpec{Cidr: cidr, IPItems: &v1beta1.IPItemList{Items: items}},
+		}
+	}
+	// Both cidrs were removed from the BGPConfiguration, which is gone, while
+	// the manager was down.
+	r := newCalicoReconciler(t, nil,
+		calicoConfig("10.0.1.0/29", v1beta1.IPItem{IP: "10.0.1.2", Owner: "default/web"}),
+		calicoConfig("10.0.2.0/29"))
+	r.Services.IPAM = ipam.NewIPAMManager(ipam.NewCRDStore(r.Client, r.Client, "bgplb-system"))
+	r.Services.PoolNamespace = "bgplb-system"
+	r.IPAM = r.Services.IPAM
+	if err := r.Services.LoadPools(r.Client); err != nil {
+		t.Fatal(err)
+	}
+	if r.IPAM.HasPool(ipam.PoolName("10.0.2.0/29")) {
+		t.Error("expected the pool without allocations not to be restored")
+	}
+	if holders := r.IPAM.Holders("10.0.1.2"); len(holders) != 1 || holders[0] != "default/web" {
+		t.Fatalf("expected 10.0.1.2 to be restored for default/web, got %v", holders)
+	}
+
+	reconcileCalico(t, r)
+	if status := r.IPAM.Status(ipam.PoolName("10.0.1.0/29")); status == nil || !status.Draining {
+		t.Errorf("expected the restored pool to drain, got %+v", status)
+	}
+	if err := r.IPAM.ReleaseIP("10.0.1.2", "default/web"); err != nil {
+		t.Fatal(err)
+	}
+	if r.IPAM.HasPool(ipam.PoolName("10.0.1.0/29")) {
+		t.Error("expected the pool to be removed with its last allocation")
+	}
+}
@@ -0,0 +1,137 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strings"
+
+	"github.com/LambdaHJ/bgplb/api/v1beta1"
+	"github.com/LambdaHJ/bgplb/pkg/ipam"
+	"github.com/LambdaHJ/bgplb/pkg/util"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// ConflictReconciler keeps the pools from handing out addresses of the
+// cluster: the Service cidrs, the Calico IPPools and the node addresses.
+type ConflictReconciler struct {
+	client.Client
+	Log      logr.Logger
+	Scheme   *runtime.Scheme
+	IPAM     *ipam.IPAMManager
+	Recorder record.EventRecorder
+	// ServiceCidrs are the cidrs of the cluster ips, which are not exposed
+	// by the api.
+	ServiceCidrs []string
+	// PoolNamespace is the namespace of the BGPIPsConfigs the conflicts are
+	// reported on.
+	PoolNamespace string
+}
+
+// +kubebuilder:rbac:groups=core,resources=nodes,verbs=get;list;watch
+// +kubebuilder:rbac:groups=crd.projectcalico.org,resources=ippools,verbs=get;list;watch
+
+func (r *ConflictReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
+	ctx := context.Background()
+	reqLog := r.Log.WithValues("conflict", req.NamespacedName)
+
+	reservations := make(map[string][]string)
+	if len(r.ServiceCidrs) > 0 {
+		reservations["service-cidr"] = r.ServiceCidrs
+	}
+	ipPools := &v1beta1.IPPoolList{}
+	if err := r.List(ctx, ipPools); err != nil {
+		return ctrl.Result{}, err
+	}
+	for i := range ipPools.Items {
+		reservations["ippool/"+ipPools.Items[i].Name] = reservedAddresses(&ipPools.Items[i])
+	}
+	nodes := &corev1.NodeList{}
+	if err := r.List(ctx, nodes); err != nil {
+		return ctrl.Result{}, err
+	}
+	for i := range nodes.Items {
+		reservations["node/"+nodes.Items[i].Name] = reservedAddresses(&nodes.Items[i])
+	}
+
+	changed, err := r.IPAM.Reserve(reservations)
+	if err != nil {
+		reqLog.Error(err, "reserve addresses error")
+		return ctrl.Result{}, nil
+	}
+	for _, name := range changed {
+		status := r.IPAM.Status(name)
+		if status == nil {
+			continue
+		}
+		conf := &v1beta1.BGPIPsConfig{}
+		conf.Name = name
+		conf.Namespace = r.PoolNamespace
+		if len(status.Conflicts) == 0 {
+			reqLog.Info("pool conflicts resolved", "pool", name)
+			r.Recorder.Event(conf, corev1.EventTypeNormal, "ConflictResolved", "pool no longer overlaps cluster addresses")
+			continue
+		}
+		reqLog.Info("pool overlaps cluster addresses, they are not handed out", "pool", name, "conflicts", status.Conflicts)
+		r.Recorder.Eventf(conf, corev1.EventTypeWarning, "Conflict",
+			"pool overlaps cluster addresses, they are not handed out: %s", strings.Join(status.Conflicts, ", "))
+	}
+
+	return ctrl.Result{}, nil
+}
+
+// reservedAddresses returns the addresses of the cluster held by obj.
+func reservedAddresses(obj runtime.Object) []string {
+	switch o := obj.(type) {
+	case *v1beta1.IPPool:
+		return []string{o.Spec.Cidr}
+	case *corev1.Node:
+		var addrs []string
+		for _, addr := range o.Status.Addresses {
+			if addr.Type == corev1.NodeInternalIP || addr.Type == corev1.NodeExternalIP {
+				addrs = append(addrs, addr.Address)
+			}
+		}
+		return addrs
+	}
+	return nil
+}
+
+func (r *ConflictReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	// Nodes are updated all the time, only address changes matter.
+	p := predicate.Funcs{
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			return !util.EqualStrings(reservedAddresses(e.ObjectOld), reservedAddresses(e.ObjectNew))
+		},
+	}
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("conflict").
+		For(&corev1.Node{}).
+		Watches(&source.Kind{Type: &v1beta1.IPPool{}}, &handler.EnqueueRequestForObject{}).
+		WithEventFilter(p).
+		Complete(r)
+}
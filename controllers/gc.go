@@ -0,0 +1,190 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/LambdaHJ/bgplb/api/v1beta1"
+	"github.com/LambdaHJ/bgplb/pkg/ipam"
+	"github.com/LambdaHJ/bgplb/pkg/validate"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var (
+	gcRuns = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "bgplb_ipam_gc_runs_total",
+		Help: "Number of times the ipam was searched for leaked ips.",
+	})
+	gcReleased = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bgplb_ipam_gc_released_ips_total",
+		Help: "Number of leaked ips released by the ipam garbage collector, by pool.",
+	}, []string{"pool"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(gcRuns, gcReleased)
+}
+
+// GarbageCollector periodically releases the ips the ipam still holds for
+// services which are gone or no longer of type LoadBalancer, such as
+// services deleted while the manager was down. Collect is not safe for
+// concurrent use.
+type GarbageCollector struct {
+	client.Client
+	Log      logr.Logger
+	IPAM     *ipam.IPAMManager
+	Recorder record.EventRecorder
+	// Interval is the time between two collections.
+	Interval time.Duration
+	// PoolNamespace is the namespace of the BGPIPsConfigs the released ips
+	// are reported on.
+	PoolNamespace string
+	// Grace is how long an owner has to be found without its service before
+	// its ips are released, so that the allocations restored at startup or
+	// imported from a snapshot are kept until their services are recreated.
+	Grace time.Duration
+
+	// missing records since when the owners without a service were found
+	// so, now is time.Now unless set by tests.
+	missing map[string]time.Time
+	now     func() time.Time
+}
+
+// Start collects every Interval until stop is closed.
+func (gc *GarbageCollector) Start(stop <-chan struct{}) error {
+	ticker := time.NewTicker(gc.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+			if _, err := gc.Collect(context.Background()); err != nil {
+				gc.Log.Error(err, "collect leaked ips error")
+			}
+		}
+	}
+}
+
+// NeedLeaderElection lets the leader collect only.
+func (gc *GarbageCollector) NeedLeaderElection() bool {
+	return true
+}
+
+// Collect releases the leaked ips and returns them by owner.
+func (gc *GarbageCollector) Collect(ctx context.Context) (map[string][]string, error) {
+	// The allocations are looked at before the services: a service which
+	// acquired an ip since is listed by then.
+	owners := gc.IPAM.Owners()
+
+	live := make(map[string]bool)
+	svcs := &corev1.ServiceList{}
+	filterOptions := &client.ListOptions{Limit: listPageSize}
+	for {
+		if err := gc.List(ctx, svcs, filterOptions); err != nil {
+			return nil, err
+		}
+		for i := range svcs.Items {
+			if validate.IsTypeLoadBalancer(&svcs.Items[i]) {
+				live[svcs.Items[i].Namespace+"/"+svcs.Items[i].Name] = true
+			}
+		}
+		if svcs.Continue == "" {
+			break
+		}
+		filterOptions.Continue = svcs.Continue
+		svcs.Continue = ""
+	}
+
+	now := time.Now()
+	if gc.now != nil {
+		now = gc.now()
+	}
+	missing := make(map[string]time.Time)
+	defer func() { gc.missing = missing }()
+
+	leaked := make(map[string][]string)
+	for owner, ips := range owners {
+		if live[owner] {
+			continue
+		}
+		// The service may have come back since it was listed.
+		if back, err := gc.serviceExists(ctx, owner); err != nil || back {
+			if err != nil {
+				gc.Log.Error(err, "get service error", "service", owner)
+			}
+			continue
+		}
+		since, ok := gc.missing[owner]
+		if !ok {
+			since = now
+		}
+		if now.Sub(since) < gc.Grace {
+			missing[owner] = since
+			continue
+		}
+		// The pool of an ip may go away with it when draining.
+		pools := make(map[string]string, len(ips))
+		for _, ip := range ips {
+			pools[ip] = gc.IPAM.PoolOf(ip)
+		}
+		released, err := gc.IPAM.ReleaseOwner(owner)
+		if err != nil {
+			return leaked, err
+		}
+		for _, ip := range released {
+			gc.Log.Info("release leaked ip", "ip", ip, "service", owner, "pool", pools[ip])
+			conf := &v1beta1.BGPIPsConfig{}
+			conf.Name = pools[ip]
+			conf.Namespace = gc.PoolNamespace
+			gc.Recorder.Eventf(conf, corev1.EventTypeNormal, "LeakedIPReleased",
+				"ip %s was still held by %s which is gone", ip, owner)
+			gcReleased.WithLabelValues(pools[ip]).Inc()
+		}
+		leaked[owner] = released
+	}
+	gcRuns.Inc()
+	return leaked, nil
+}
+
+// serviceExists reports whether owner, given as namespace/name, is a
+// LoadBalancer service.
+func (gc *GarbageCollector) serviceExists(ctx context.Context, owner string) (bool, error) {
+	parts := strings.SplitN(owner, "/", 2)
+	if len(parts) != 2 {
+		return false, nil
+	}
+	svc := &corev1.Service{}
+	if err := gc.Get(ctx, types.NamespacedName{Namespace: parts[0], Name: parts[1]}, svc); err != nil {
+		if errors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return validate.IsTypeLoadBalancer(svc), nil
+}
@@ -0,0 +1,133 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/LambdaHJ/bgplb/pkg/ipam"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+func TestGarbageCollect(t *testing.T) {
+	clusterIP := loadBalancer("default", "internal", nil)
+	clusterIP.Spec.Type = corev1.ServiceTypeClusterIP
+	r := newServiceReconciler(t, []*ipam.Pool{{Name: "a", Cidr: "10.0.0.0/29"}},
+		loadBalancer("default", "web", nil), clusterIP)
+	held := map[string]string{
+		"10.0.0.2": "default/web",
+		"10.0.0.3": "default/gone",
+		"10.0.0.4": "default/internal",
+	}
+	for ip, owner := range held {
+		if !r.IPAM.AddUsedIP(ip, &ipam.Request{Owner: owner}) {
+			t.Fatalf("expected to restore %s for %s", ip, owner)
+		}
+	}
+	recorder := record.NewFakeRecorder(10)
+	gc := &GarbageCollector{
+		Client:        r.Client,
+		Log:           ctrl.Log.WithName("test"),
+		IPAM:          r.IPAM,
+		Recorder:      recorder,
+		PoolNamespace: "bgplb-system",
+	}
+
+	leaked, err := gc.Collect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{
+		"default/gone":     {"10.0.0.3"},
+		"default/internal": {"10.0.0.4"},
+	}
+	if !reflect.DeepEqual(leaked, want) {
+		t.Errorf("expected %v to be released, got %v", want, leaked)
+	}
+	// The ip of the live LoadBalancer service is kept.
+	if holders := r.IPAM.Holders("10.0.0.2"); !reflect.DeepEqual(holders, []string{"default/web"}) {
+		t.Errorf("expected 10.0.0.2 to be kept for default/web, got %v", holders)
+	}
+	for _, ip := range []string{"10.0.0.3", "10.0.0.4"} {
+		if holders := r.IPAM.Holders(ip); holders != nil {
+			t.Errorf("expected %s to be released, got %v", ip, holders)
+		}
+	}
+	if len(recorder.Events) != 2 {
+		t.Fatalf("expected two events, got %d", len(recorder.Events))
+	}
+	for i := 0; i < 2; i++ {
+		if event := <-recorder.Events; !strings.Contains(event, "LeakedIPReleased") {
+			t.Errorf("unexpected event %q", event)
+		}
+	}
+
+	// Nothing is left to collect.
+	if leaked, err := gc.Collect(context.Background()); err != nil || len(leaked) != 0 {
+		t.Errorf("expected nothing to be released, got %v %v", leaked, err)
+	}
+}
+
+func TestGarbageCollectGrace(t *testing.T) {
+	r := newServiceReconciler(t, []*ipam.Pool{{Name: "a", Cidr: "10.0.0.0/29"}})
+	// Both were restored from a snapshot before their services were
+	// recreated.
+	for ip, owner := range map[string]string{"10.0.0.2": "default/web", "10.0.0.3": "default/gone"} {
+		if !r.IPAM.AddUsedIP(ip, &ipam.Request{Owner: owner}) {
+			t.Fatalf("expected to restore %s for %s", ip, owner)
+		}
+	}
+	clock := time.Now()
+	gc := &GarbageCollector{
+		Client:        r.Client,
+		Log:           ctrl.Log.WithName("test"),
+		IPAM:          r.IPAM,
+		Recorder:      record.NewFakeRecorder(10),
+		PoolNamespace: "bgplb-system",
+		Grace:         time.Hour,
+		now:           func() time.Time { return clock },
+	}
+
+	for _, elapsed := range []time.Duration{0, 30 * time.Minute} {
+		clock = clock.Add(elapsed)
+		if leaked, err := gc.Collect(context.Background()); err != nil || len(leaked) != 0 {
+			t.Fatalf("expected nothing to be released within the grace period, got %v %v", leaked, err)
+		}
+	}
+	if err := r.Create(context.Background(), loadBalancer("default", "web", nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	clock = clock.Add(31 * time.Minute)
+	leaked, err := gc.Collect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string][]string{"default/gone": {"10.0.0.3"}}; !reflect.DeepEqual(leaked, want) {
+		t.Errorf("expected %v to be released, got %v", want, leaked)
+	}
+	if holders := r.IPAM.Holders("10.0.0.2"); !reflect.DeepEqual(holders, []string{"default/web"}) {
+		t.Errorf("expected the recreated service to keep 10.0.0.2, got %v", holders)
+	}
+}
@@ -0,0 +1,74 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"sync"
+
+	"github.com/go-logr/logr"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// IPAMInitializer restores the ipam once the manager is elected leader and
+// only then sets up the controllers working on it. A standby neither loads
+// a state which gets stale while it waits nor writes to the store, it
+// restores the state of the moment it takes over instead.
+type IPAMInitializer struct {
+	Manager ctrl.Manager
+	Log     logr.Logger
+	// Services restores the pools and the allocations.
+	Services *BGPConfigReconciler
+	// Setup adds the controllers and runnables using the ipam to Manager,
+	// they are started right away since the manager is running by then.
+	Setup func(mgr ctrl.Manager) error
+
+	lock  sync.RWMutex
+	ready bool
+}
+
+// Start restores the ipam and sets up the controllers. A failure stops the
+// manager, which gives up leadership for another replica to try.
+func (i *IPAMInitializer) Start(stop <-chan struct{}) error {
+	if err := i.Services.Init(i.Manager.GetAPIReader()); err != nil {
+		i.Log.Error(err, "unable to init ipam")
+		return err
+	}
+	if err := i.Setup(i.Manager); err != nil {
+		i.Log.Error(err, "unable to set up controllers")
+		return err
+	}
+	i.lock.Lock()
+	i.ready = true
+	i.lock.Unlock()
+
+	<-stop
+	return nil
+}
+
+// NeedLeaderElection lets the leader restore the ipam only.
+func (i *IPAMInitializer) NeedLeaderElection() bool {
+	return true
+}
+
+// Ready reports whether the ipam was restored, which only happens on the
+// leader.
+func (i *IPAMInitializer) Ready() bool {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	return i.ready
+}
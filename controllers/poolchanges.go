@@ -0,0 +1,71 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import "sync"
+
+// poolChanges coalesces the pools notified as changed and hands them to a
+// single goroutine, so that a burst of changes, e.g. while allocations are
+// restored, neither blocks the ipam nor piles up goroutines. A pool notified
+// again while it still waits is handed over once.
+type poolChanges struct {
+	lock    sync.Mutex
+	pending map[string]bool
+	// wake signals the goroutine that pools are pending, it is nil until
+	// start.
+	wake chan struct{}
+}
+
+// notify records pool as changed. It never blocks, pools notified before
+// start are handed over once started.
+func (c *poolChanges) notify(pool string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.pending == nil {
+		c.pending = make(map[string]bool)
+	}
+	c.pending[pool] = true
+	if c.wake != nil {
+		select {
+		case c.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// start calls send for every pool notified, one at a time, from a goroutine
+// of its own.
+func (c *poolChanges) start(send func(pool string)) {
+	c.lock.Lock()
+	c.wake = make(chan struct{}, 1)
+	c.wake <- struct{}{}
+	c.lock.Unlock()
+
+	go func() {
+		for range c.wake {
+			c.lock.Lock()
+			pools := c.pending
+			c.pending = nil
+			c.lock.Unlock()
+
+			for pool := range pools {
+				send(pool)
+			}
+		}
+	}()
+}
@@ -0,0 +1,61 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestPoolChangesCoalesce(t *testing.T) {
+	var c poolChanges
+	// Notifying never blocks, not even before start.
+	for i := 0; i < 10000; i++ {
+		c.notify(fmt.Sprintf("pool-%d", i%3))
+	}
+
+	sent := make(chan string)
+	c.start(func(pool string) {
+		sent <- pool
+	})
+	seen := make(map[string]int)
+	for len(seen) < 3 {
+		select {
+		case pool := <-sent:
+			seen[pool]++
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected the notified pools to be sent, got %v", seen)
+		}
+	}
+	select {
+	case pool := <-sent:
+		t.Errorf("expected the notifications to be coalesced, %s was sent again", pool)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Later notifications are sent as well.
+	c.notify("pool-0")
+	select {
+	case pool := <-sent:
+		if pool != "pool-0" {
+			t.Errorf("unexpected pool %s", pool)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected pool-0 to be sent")
+	}
+}
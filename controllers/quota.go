@@ -0,0 +1,154 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/LambdaHJ/bgplb/pkg/ipam"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// ipQuotaAnnotation caps the number of ips the services of a namespace may
+// hold, it overrides BGPConfigReconciler.DefaultQuota.
+const ipQuotaAnnotation = "lb.lambdahj.site/ip-quota"
+
+// poolQuotaAnnotation caps the number of ips the services of a namespace may
+// hold per pool, as a comma separated list of pool=count.
+const poolQuotaAnnotation = "lb.lambdahj.site/pool-quota"
+
+// unlimited is the quota left of namespaces without a quota.
+const unlimited = -1
+
+// quota is what is left of the quota of a namespace.
+type quota struct {
+	// left is how many more ips the namespace may acquire, or unlimited.
+	left int
+	// pools is how many more ips it may acquire from each pool with a quota.
+	pools map[string]int
+}
+
+// request returns req with the pools where no quota is left skipped.
+func (q *quota) request(req *ipam.Request) *ipam.Request {
+	skip := *req
+	skip.SkipPools = append([]string(nil), req.SkipPools...)
+	for pool, left := range q.pools {
+		if left <= 0 {
+			skip.SkipPools = append(skip.SkipPools, pool)
+		}
+	}
+	return &skip
+}
+
+// take accounts for an ip acquired from pool, which only counts against
+// the quota of the namespace unless it replaces an ip.
+func (q *quota) take(pool string, replacement bool) {
+	if left, ok := q.pools[pool]; ok {
+		q.pools[pool] = left - 1
+	}
+	if !replacement && q.left > 0 {
+		q.left--
+	}
+}
+
+// quotaLeft returns what is left of the quota of the services of ns.
+func (r *BGPConfigReconciler) quotaLeft(ns *corev1.Namespace) (*quota, error) {
+	usage := r.IPAM.NamespaceUsage(ns.Name)
+	q := &quota{pools: make(map[string]int)}
+
+	if pools, ok := ns.Annotations[poolQuotaAnnotation]; ok {
+		for _, entry := range strings.Split(pools, ",") {
+			if entry = strings.TrimSpace(entry); entry == "" {
+				continue
+			}
+			parts := strings.SplitN(entry, "=", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("invalid %s entry %q", poolQuotaAnnotation, entry)
+			}
+			pool := strings.TrimSpace(parts[0])
+			n, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid %s entry %q", poolQuotaAnnotation, entry)
+			}
+			q.pools[pool] = n - usage[pool]
+		}
+	}
+
+	total := r.DefaultQuota
+	if s, ok := ns.Annotations[ipQuotaAnnotation]; ok {
+		n, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid %s %q", ipQuotaAnnotation, s)
+		}
+		total = n
+	} else if total <= 0 {
+		q.left = unlimited
+		return q, nil
+	}
+	used := 0
+	for _, n := range usage {
+		used += n
+	}
+	if used < total {
+		q.left = total - used
+	}
+	return q, nil
+}
+
+// namespaceLocks holds one mutex per namespace, so that concurrent
+// reconciles of the services of a namespace do not exceed its quota
+// together. A mutex goes away once nobody holds or waits for it.
+type namespaceLocks struct {
+	lock  sync.Mutex
+	locks map[string]*namespaceLock
+}
+
+type namespaceLock struct {
+	sync.Mutex
+	refs int
+}
+
+func (l *namespaceLocks) Lock(namespace string) {
+	l.lock.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*namespaceLock)
+	}
+	nl, ok := l.locks[namespace]
+	if !ok {
+		nl = &namespaceLock{}
+		l.locks[namespace] = nl
+	}
+	nl.refs++
+	l.lock.Unlock()
+
+	nl.Lock()
+}
+
+func (l *namespaceLocks) Unlock(namespace string) {
+	l.lock.Lock()
+	nl := l.locks[namespace]
+	if nl.refs--; nl.refs == 0 {
+		delete(l.locks, namespace)
+	}
+	l.lock.Unlock()
+
+	nl.Unlock()
+}
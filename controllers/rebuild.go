@@ -0,0 +1,191 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/LambdaHJ/bgplb/pkg/util"
+	"github.com/LambdaHJ/bgplb/pkg/validate"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+const (
+	// RebuildKeepOldest gives an ip claimed by several services to the
+	// oldest of them and drops it from the status of the others, which get
+	// new ips. Ips outside of every pool are only reported.
+	RebuildKeepOldest = "KeepOldest"
+	// RebuildReport only reports the services claiming the same ip and the
+	// ips outside of every pool, the ipam keeps what its store recorded.
+	RebuildReport = "Report"
+	// RebuildReassign resolves the services claiming the same ip like
+	// RebuildKeepOldest, and drops the ips outside of every pool from the
+	// status of their services as well, which get new ips.
+	RebuildReassign = "Reassign"
+)
+
+// rebuild restores the ips found in the status of the LoadBalancer
+// services into the ipam, on top of the allocations loaded from the store.
+// Services still waiting for an ip are skipped. Services claiming an ip held
+// by another service and ips outside of every pool are resolved according to
+// RebuildPolicy.
+func (r *BGPConfigReconciler) rebuild(ctx context.Context, reader client.Reader) error {
+	policy := r.RebuildPolicy
+	switch policy {
+	case "":
+		policy = RebuildKeepOldest
+	case RebuildKeepOldest, RebuildReport, RebuildReassign:
+	default:
+		return fmt.Errorf("unknown rebuild policy %q", policy)
+	}
+
+	var svcs []corev1.Service
+	list := &corev1.ServiceList{}
+	filterOptions := &client.ListOptions{Limit: listPageSize}
+	for {
+		if err := reader.List(ctx, list, filterOptions); err != nil {
+			return err
+		}
+		for i := range list.Items {
+			if validate.IsTypeLoadBalancer(&list.Items[i]) {
+				svcs = append(svcs, list.Items[i])
+			}
+		}
+		if list.Continue == "" {
+			break
+		}
+		filterOptions.Continue = list.Continue
+		list.Continue = ""
+	}
+	// The oldest service claiming an ip comes first.
+	sort.SliceStable(svcs, func(i, j int) bool {
+		if !svcs[i].CreationTimestamp.Equal(&svcs[j].CreationTimestamp) {
+			return svcs[i].CreationTimestamp.Before(&svcs[j].CreationTimestamp)
+		}
+		if svcs[i].Namespace != svcs[j].Namespace {
+			return svcs[i].Namespace < svcs[j].Namespace
+		}
+		return svcs[i].Name < svcs[j].Name
+	})
+
+	var ips []string
+	claims := make(map[string][]*corev1.Service)
+	for i := range svcs {
+		for _, ingress := range svcs[i].Status.LoadBalancer.Ingress {
+			if ingress.IP == "" {
+				continue
+			}
+			if _, ok := claims[ingress.IP]; !ok {
+				ips = append(ips, ingress.IP)
+			}
+			claims[ingress.IP] = append(claims[ingress.IP], &svcs[i])
+		}
+	}
+
+	// dropped are the ips to remove from the status of every service.
+	dropped := make(map[*corev1.Service][]string)
+	restored, duplicates, outside := 0, 0, 0
+	for _, ip := range ips {
+		claimants := claims[ip]
+		if r.IPAM.PoolOf(ip) == "" {
+			for _, svc := range claimants {
+				outside++
+				r.rebuildWarning(svc, "IPOutOfPool", "ip %s is not part of any pool", ip)
+				if policy == RebuildReassign {
+					dropped[svc] = append(dropped[svc], ip)
+				}
+			}
+			continue
+		}
+		if policy != RebuildReport {
+			r.evict(ip, claimants[0])
+		}
+		for _, svc := range claimants {
+			if r.IPAM.AddUsedIP(ip, serviceRequest(svc)) {
+				restored++
+				continue
+			}
+			duplicates++
+			r.rebuildWarning(svc, "DuplicateIP", "ip %s is held by %v", ip, r.IPAM.Holders(ip))
+			if policy != RebuildReport {
+				dropped[svc] = append(dropped[svc], ip)
+			}
+		}
+	}
+	r.Log.Info("rebuild allocations", "policy", policy, "restored", restored,
+		"duplicates", duplicates, "outOfPool", outside)
+
+	return r.dropIPs(ctx, dropped)
+}
+
+// evict releases ip from the holders keeping svc from holding it, which are
+// not necessarily services claiming ip, so that svc gets it.
+func (r *BGPConfigReconciler) evict(ip string, svc *corev1.Service) {
+	req := serviceRequest(svc)
+	if r.IPAM.AddUsedIP(ip, req) {
+		return
+	}
+	for _, holder := range r.IPAM.Holders(ip) {
+		r.Log.Info("evict ip", "ip", ip, "holder", holder, "service", req.Owner)
+		if err := r.IPAM.ReleaseIP(ip, holder); err != nil {
+			r.Log.Error(err, "evict ip error", "ip", ip, "holder", holder)
+		}
+	}
+}
+
+// dropIPs removes ips from the status of the services and requeues them so
+// that they get new ips.
+func (r *BGPConfigReconciler) dropIPs(ctx context.Context, dropped map[*corev1.Service][]string) error {
+	if len(dropped) == 0 {
+		return nil
+	}
+	svcs := make([]corev1.Service, 0, len(dropped))
+	for svc, ips := range dropped {
+		kept := svc.Status.LoadBalancer.Ingress[:0]
+		for _, ingress := range svc.Status.LoadBalancer.Ingress {
+			if !util.ContainsString(ips, ingress.IP) {
+				kept = append(kept, ingress)
+			}
+		}
+		svc.Status.LoadBalancer.Ingress = kept
+		if err := r.Status().Update(ctx, svc); err != nil {
+			return err
+		}
+		r.Log.Info("reassign ips", "ip", ips, "service", serviceRequest(svc).Owner)
+		svcs = append(svcs, *svc)
+	}
+	if r.pending == nil {
+		r.pending = make(chan event.GenericEvent)
+	}
+	r.requeue(svcs)
+	return nil
+}
+
+// rebuildWarning reports a problem found with svc while rebuilding. The
+// recorder is unset when rebuilding outside of the manager.
+func (r *BGPConfigReconciler) rebuildWarning(svc *corev1.Service, reason, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	r.Log.Info(message, "service", serviceRequest(svc).Owner, "reason", reason)
+	if r.Recorder != nil {
+		r.Recorder.Event(svc, corev1.EventTypeWarning, reason, message)
+	}
+}
@@ -0,0 +1,129 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/LambdaHJ/bgplb/pkg/ipam"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// claiming returns a LoadBalancer service created at created with ips in
+// its status.
+func claiming(name string, created time.Time, ips ...string) *corev1.Service {
+	svc := loadBalancer("default", name, nil)
+	svc.CreationTimestamp = metav1.NewTime(created)
+	for _, ip := range ips {
+		svc.Status.LoadBalancer.Ingress = append(svc.Status.LoadBalancer.Ingress, corev1.LoadBalancerIngress{IP: ip})
+	}
+	return svc
+}
+
+// requeued returns the names of the services requeued by r, sorted.
+func requeued(r *BGPConfigReconciler) []string {
+	var names []string
+	for {
+		select {
+		case e := <-r.pending:
+			names = append(names, e.Meta.GetName())
+		case <-time.After(100 * time.Millisecond):
+			sort.Strings(names)
+			return names
+		}
+	}
+}
+
+func TestRebuildPolicies(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		policy string
+		// holder is the service holding the shared ip after the rebuild.
+		holder string
+		// statuses are the ips left in the status of every service.
+		statuses map[string][]string
+		requeued []string
+	}{
+		{
+			policy: RebuildKeepOldest,
+			holder: "default/old",
+			statuses: map[string][]string{
+				"old":   {"10.0.0.2"},
+				"young": nil,
+				"stray": {"10.9.9.9"},
+			},
+			requeued: []string{"young"},
+		},
+		{
+			policy: RebuildReport,
+			holder: "default/young",
+			statuses: map[string][]string{
+				"old":   {"10.0.0.2"},
+				"young": {"10.0.0.2"},
+				"stray": {"10.9.9.9"},
+			},
+		},
+		{
+			policy: RebuildReassign,
+			holder: "default/old",
+			statuses: map[string][]string{
+				"old":   {"10.0.0.2"},
+				"young": nil,
+				"stray": nil,
+			},
+			requeued: []string{"stray", "young"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.policy, func(t *testing.T) {
+			r := newServiceReconciler(t, []*ipam.Pool{{Name: "a", Cidr: "10.0.0.0/29"}},
+				claiming("old", now.Add(-time.Hour), "10.0.0.2"),
+				claiming("young", now, "10.0.0.2"),
+				claiming("stray", now, "10.9.9.9"))
+			r.RebuildPolicy = test.policy
+			// The store recorded the ip for the younger service.
+			if !r.IPAM.AddUsedIP("10.0.0.2", &ipam.Request{Owner: "default/young", Ports: []string{"TCP/80"}}) {
+				t.Fatal("expected to restore 10.0.0.2")
+			}
+
+			if err := r.rebuild(context.Background(), r.Client); err != nil {
+				t.Fatal(err)
+			}
+			if holders := r.IPAM.Holders("10.0.0.2"); !reflect.DeepEqual(holders, []string{test.holder}) {
+				t.Errorf("expected 10.0.0.2 to be held by %s, got %v", test.holder, holders)
+			}
+			for name, want := range test.statuses {
+				if ips := ingressIPs(t, r.Client, "default", name); !reflect.DeepEqual(ips, want) {
+					t.Errorf("expected %s to keep %v, got %v", name, want, ips)
+				}
+			}
+			if r.pending != nil {
+				if names := requeued(r); !reflect.DeepEqual(names, test.requeued) {
+					t.Errorf("expected %v to be requeued, got %v", test.requeued, names)
+				}
+			} else if test.requeued != nil {
+				t.Errorf("expected %v to be requeued, got none", test.requeued)
+			}
+		})
+	}
+}
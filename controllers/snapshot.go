@@ -0,0 +1,140 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/LambdaHJ/bgplb/api/v1beta1"
+	"github.com/LambdaHJ/bgplb/pkg/ipam"
+
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// ReadSnapshot decodes the snapshot of r and validates it, fields unknown
+// to the snapshot format are refused.
+func ReadSnapshot(r io.Reader) (*ipam.Snapshot, error) {
+	snapshot := &ipam.Snapshot{}
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(snapshot); err != nil {
+		return nil, fmt.Errorf("invalid snapshot: %v", err)
+	}
+	if err := snapshot.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid snapshot: %v", err)
+	}
+	return snapshot, nil
+}
+
+// RestoreSnapshot imports snapshot into im, then creates the BGPIPsConfig
+// of every pool of snapshot which does not exist yet in namespace. The
+// imported state is only saved once the BGPIPsConfigs exist. A snapshot
+// which is invalid or which im refuses changes nothing.
+func RestoreSnapshot(ctx context.Context, c client.Client, namespace string, im *ipam.IPAMManager, snapshot *ipam.Snapshot) error {
+	if err := snapshot.Validate(); err != nil {
+		return err
+	}
+	var confs []*v1beta1.BGPIPsConfig
+	for i := range snapshot.Pools {
+		if snapshot.Pools[i].FromCalico {
+			continue
+		}
+		conf, err := snapshot.Pools[i].Config()
+		if err != nil {
+			return err
+		}
+		conf.Namespace = namespace
+		confs = append(confs, conf)
+	}
+
+	var err error
+	flushErr := im.Batch(func() {
+		if err = im.Import(snapshot); err != nil {
+			return
+		}
+		for _, conf := range confs {
+			if err = c.Create(ctx, conf); err != nil && !errors.IsAlreadyExists(err) {
+				return
+			}
+		}
+		err = nil
+	})
+	if err != nil {
+		return err
+	}
+	return flushErr
+}
+
+// SnapshotHandler serves the snapshot of IPAM on GET and, with Import set,
+// restores the snapshot in the request body on POST, validated like the
+// snapshot subcommand does. Only the leader has the ipam restored, the other
+// replicas answer with 503. It is served on the metrics address, behind the
+// same auth proxy as the metrics.
+type SnapshotHandler struct {
+	Client client.Client
+	Log    logr.Logger
+	IPAM   *ipam.IPAMManager
+	// PoolNamespace is the namespace the BGPIPsConfigs are created in.
+	PoolNamespace string
+	// Import enables POST, which replaces the allocations of the pools of
+	// the snapshot.
+	Import bool
+	// Ready reports whether IPAM was restored.
+	Ready func() bool
+}
+
+func (h *SnapshotHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && (req.Method != http.MethodPost || !h.Import) {
+		if h.Import {
+			w.Header().Set("Allow", "GET, POST")
+		} else {
+			w.Header().Set("Allow", "GET")
+		}
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.Ready() {
+		http.Error(w, "the ipam is only served by the leader", http.StatusServiceUnavailable)
+		return
+	}
+	if req.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(h.IPAM.Export()); err != nil {
+			h.Log.Error(err, "write snapshot error")
+		}
+		return
+	}
+
+	snapshot, err := ReadSnapshot(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := RestoreSnapshot(req.Context(), h.Client, h.PoolNamespace, h.IPAM, snapshot); err != nil {
+		h.Log.Error(err, "restore snapshot error")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.Log.Info("restored snapshot", "pools", len(snapshot.Pools))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,131 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/LambdaHJ/bgplb/api/v1beta1"
+	"github.com/LambdaHJ/bgplb/pkg/ipam"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+func TestSnapshotHandler(t *testing.T) {
+	source := ipam.NewIPAMManager(ipam.NewMemoryStore())
+	if err := source.AddPool(&ipam.Pool{Name: "a", Cidr: "10.0.0.0/29"}); err != nil {
+		t.Fatal(err)
+	}
+	if !source.AcquireSpecificIP("10.0.0.2", &ipam.Request{Owner: "default/web"}) {
+		t.Fatal("expected to acquire 10.0.0.2")
+	}
+	body, err := json.Marshal(source.Export())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := newServiceReconciler(t, nil)
+	ready := false
+	h := &SnapshotHandler{
+		Client:        r.Client,
+		Log:           ctrl.Log.WithName("test"),
+		IPAM:          r.IPAM,
+		PoolNamespace: "bgplb-system",
+		Ready:         func() bool { return ready },
+	}
+	serve := func(method string, body []byte) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, "/ipam/snapshot", bytes.NewReader(body)))
+		return w
+	}
+
+	if w := serve(http.MethodPost, body); w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "GET" {
+		t.Errorf("expected POST to be refused unless enabled, got %d", w.Code)
+	}
+	h.Import = true
+	if w := serve(http.MethodPost, body); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 before the ipam is restored, got %d", w.Code)
+	}
+	ready = true
+	if w := serve(http.MethodPut, body); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405 on PUT, got %d", w.Code)
+	}
+
+	// Invalid snapshots change nothing.
+	invalid := source.Export()
+	invalid.Pools[0].State.Allocations["10.1.0.2"] = invalid.Pools[0].State.Allocations["10.0.0.2"]
+	outside, err := json.Marshal(invalid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, body := range map[string][]byte{
+		"malformed":     []byte("{"),
+		"unknown field": []byte(`{"version": 1, "pools": [], "extra": true}`),
+		"outside":       outside,
+	} {
+		if w := serve(http.MethodPost, body); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", name, w.Code)
+		}
+	}
+	conf := &v1beta1.BGPIPsConfig{}
+	key := types.NamespacedName{Namespace: "bgplb-system", Name: "a"}
+	if err := r.Get(context.Background(), key, conf); !errors.IsNotFound(err) {
+		t.Fatalf("expected no BGPIPsConfig for an invalid snapshot, got %v", err)
+	}
+
+	// Neither is a snapshot the ipam refuses, the BGPIPsConfigs are only
+	// created once it is imported.
+	if err := r.IPAM.AddPool(&ipam.Pool{Name: "c", Cidr: "10.0.0.0/30"}); err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(http.MethodPost, body); w.Code != http.StatusInternalServerError {
+		t.Errorf("expected 500 for a pool overlapping pool c, got %d", w.Code)
+	}
+	if err := r.Get(context.Background(), key, conf); !errors.IsNotFound(err) {
+		t.Fatalf("expected no BGPIPsConfig for a refused snapshot, got %v", err)
+	}
+	if err := r.IPAM.RemovePool("c"); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := serve(http.MethodPost, body); w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d: %s", w.Code, w.Body.String())
+	}
+	if err := r.Get(context.Background(), key, conf); err != nil {
+		t.Errorf("expected the BGPIPsConfig of the pool to be created, got %v", err)
+	}
+	if holders := r.IPAM.Holders("10.0.0.2"); !reflect.DeepEqual(holders, []string{"default/web"}) {
+		t.Errorf("expected 10.0.0.2 to be restored for default/web, got %v", holders)
+	}
+
+	w := serve(http.MethodGet, nil)
+	exported := &ipam.Snapshot{}
+	if err := json.NewDecoder(w.Body).Decode(exported); err != nil {
+		t.Fatal(err)
+	}
+	if len(exported.Pools) != 1 || exported.Pools[0].Name != "a" {
+		t.Errorf("expected the imported pool to be exported, got %+v", exported.Pools)
+	}
+}
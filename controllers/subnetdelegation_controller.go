@@ -0,0 +1,176 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"github.com/LambdaHJ/bgplb/api/v1beta1"
+	"github.com/LambdaHJ/bgplb/pkg/ipam"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// SubnetDelegationReconciler keeps the delegations of the ipam in sync with
+// the SubnetDelegation objects and reports their utilization in the status.
+type SubnetDelegationReconciler struct {
+	client.Client
+	Log      logr.Logger
+	Scheme   *runtime.Scheme
+	IPAM     *ipam.IPAMManager
+	Recorder record.EventRecorder
+	// Services are requeued once a namespace is delegated a new subnet, so
+	// that services waiting for an ip get one.
+	Services *BGPConfigReconciler
+
+	// changes requeues the delegations of the pools whose allocations
+	// changed, notified coalesces the notifications.
+	changes  chan event.GenericEvent
+	notified poolChanges
+}
+
+// +kubebuilder:rbac:groups=lb.lambdahj.site,resources=subnetdelegations,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=lb.lambdahj.site,resources=subnetdelegations/status,verbs=get;update;patch
+
+func (r *SubnetDelegationReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
+	ctx := context.Background()
+	reqLog := r.Log.WithValues("subnetdelegation", req.NamespacedName)
+
+	d := &v1beta1.SubnetDelegation{}
+	if err := r.Get(ctx, req.NamespacedName, d); err != nil {
+		if errors.IsNotFound(err) {
+			r.IPAM.Undelegate(req.Name)
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, err
+	}
+	if d.DeletionTimestamp != nil {
+		r.IPAM.Undelegate(d.Name)
+		return ctrl.Result{}, nil
+	}
+
+	cidr, err := r.IPAM.Delegate(ipam.DelegationFromObject(d))
+	if err != nil {
+		reqLog.Error(err, "invalid delegation")
+		return ctrl.Result{}, r.invalidStatus(ctx, d, err)
+	}
+	if cidr != d.Status.Cidr {
+		reqLog.Info("delegate subnet", "cidr", cidr, "namespace", d.Spec.Namespace)
+		r.Recorder.Eventf(d, corev1.EventTypeNormal, "Delegated", "%s delegated to namespace %s", cidr, d.Spec.Namespace)
+	}
+	if err := r.updateStatus(ctx, d); err != nil {
+		return ctrl.Result{}, err
+	}
+	if cidr != d.Status.Cidr {
+		return ctrl.Result{}, r.Services.RequeuePending(ctx)
+	}
+	return ctrl.Result{}, nil
+}
+
+// updateStatus reports the subnet delegated by d and its utilization.
+func (r *SubnetDelegationReconciler) updateStatus(ctx context.Context, d *v1beta1.SubnetDelegation) error {
+	delegationStatus := r.IPAM.DelegationStatus(d.Name)
+	if delegationStatus == nil {
+		return nil
+	}
+	return r.setStatus(ctx, d, v1beta1.SubnetDelegationStatus{
+		Cidr:  delegationStatus.Cidr,
+		Total: delegationStatus.Total,
+		Used:  delegationStatus.Used,
+		Free:  delegationStatus.Free,
+	})
+}
+
+// invalidStatus reports why d cannot be delegated, the subnet delegated so
+// far is kept in the status to be picked again.
+func (r *SubnetDelegationReconciler) invalidStatus(ctx context.Context, d *v1beta1.SubnetDelegation, cause error) error {
+	cond := newCondition(d.Status.Conditions, v1beta1.PoolConditionInvalid, "InvalidDelegation", cause.Error())
+	if len(d.Status.Conditions) != 1 || d.Status.Conditions[0] != cond {
+		r.Recorder.Event(d, corev1.EventTypeWarning, "InvalidDelegation", cause.Error())
+	}
+	return r.setStatus(ctx, d, v1beta1.SubnetDelegationStatus{
+		Cidr:       d.Status.Cidr,
+		Conditions: []v1beta1.PoolCondition{cond},
+	})
+}
+
+// setStatus updates the status of d to status unless nothing changed.
+func (r *SubnetDelegationReconciler) setStatus(ctx context.Context, d *v1beta1.SubnetDelegation, status v1beta1.SubnetDelegationStatus) error {
+	if equality.Semantic.DeepEqual(status, d.Status) {
+		return nil
+	}
+	d.Status = status
+	return r.Status().Update(ctx, d)
+}
+
+// NotifyPoolChange requeues the SubnetDelegations of pool so that their
+// status is refreshed. It never blocks, which lets it be called from
+// ipam.IPAMManager.OnChange, and may be called before SetupWithManager.
+func (r *SubnetDelegationReconciler) NotifyPoolChange(pool string) {
+	r.notified.notify(pool)
+}
+
+// delegationsOf returns the requests of the SubnetDelegations of pool.
+func (r *SubnetDelegationReconciler) delegationsOf(pool string) []reconcile.Request {
+	list := &v1beta1.SubnetDelegationList{}
+	if err := r.List(context.Background(), list); err != nil {
+		r.Log.Error(err, "list subnetdelegations error")
+		return nil
+	}
+	var reqs []reconcile.Request
+	for _, d := range list.Items {
+		if d.Spec.Pool == pool {
+			reqs = append(reqs, reconcile.Request{NamespacedName: types.NamespacedName{Name: d.Name}})
+		}
+	}
+	return reqs
+}
+
+func (r *SubnetDelegationReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	r.changes = make(chan event.GenericEvent)
+	r.notified.start(func(pool string) {
+		for _, req := range r.delegationsOf(pool) {
+			d := &v1beta1.SubnetDelegation{}
+			d.Name = req.Name
+			r.changes <- event.GenericEvent{Meta: d, Object: d}
+		}
+	})
+	// Delegations of a pool which is added, changed or removed are applied
+	// again.
+	pools := &handler.EnqueueRequestsFromMapFunc{
+		ToRequests: handler.ToRequestsFunc(func(obj handler.MapObject) []reconcile.Request {
+			return r.delegationsOf(obj.Meta.GetName())
+		}),
+	}
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&v1beta1.SubnetDelegation{}).
+		Watches(&source.Kind{Type: &v1beta1.BGPIPsConfig{}}, pools).
+		Watches(&source.Channel{Source: r.changes}, &handler.EnqueueRequestForObject{}).
+		Complete(r)
+}
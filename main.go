@@ -17,18 +17,25 @@ limitations under the License.
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
+	"fmt"
+	"io"
 	"os"
-	"sync"
+	"strings"
+	"time"
 
 	"k8s.io/apimachinery/pkg/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
 	lbv1beta1 "github.com/LambdaHJ/bgplb/api/v1beta1"
 	controllers "github.com/LambdaHJ/bgplb/controllers"
+	"github.com/LambdaHJ/bgplb/pkg/ipam"
 	// +kubebuilder:scaffold:imports
 )
 
@@ -46,12 +53,65 @@ func init() {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "snapshot" {
+		ctrl.SetLogger(zap.New(zap.UseDevMode(true)))
+		if err := runSnapshot(os.Args[2:]); err != nil {
+			setupLog.Error(err, "snapshot failed")
+			os.Exit(1)
+		}
+		return
+	}
+
 	var metricsAddr string
 	var enableLeaderElection bool
+	var ipamStore string
+	var ipamNamespace string
+	var ipQuarantine time.Duration
+	var ipRetention time.Duration
+	var drainPolicy string
+	var serviceCidrs string
+	var namespaceQuota int
+	var maxConcurrentReconciles int
+	var spreadPools bool
+	var gcInterval time.Duration
+	var gcGrace time.Duration
+	var rebuildPolicy string
+	var snapshotImport bool
 	flag.StringVar(&metricsAddr, "metrics-addr", ":8080", "The address the metric endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "enable-leader-election", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.StringVar(&ipamStore, "ipam-store", ipam.StoreCRD,
+		"Where ip allocations are persisted, one of memory, crd or configmap.")
+	flag.StringVar(&ipamNamespace, "ipam-namespace", "bgplb-system",
+		"The namespace of the BGPIPsConfigs, and of the ConfigMaps used by the configmap ipam store.")
+	flag.DurationVar(&ipQuarantine, "ip-quarantine", 0,
+		"How long a released ip is kept from being handed out again, 0 disables the quarantine.")
+	flag.DurationVar(&ipRetention, "ip-retention", 0,
+		"How long the ip of a deleted service is kept for it to get back when recreated, 0 disables sticky ips.")
+	flag.StringVar(&drainPolicy, "drain-policy", ipam.DrainKeep,
+		"What happens to the services of a pool removed while in use, Keep or Migrate to other pools.")
+	flag.StringVar(&serviceCidrs, "service-cidr", "",
+		"Comma separated cidrs of the cluster ips, they are never handed out.")
+	flag.IntVar(&namespaceQuota, "namespace-ip-quota", 0,
+		"How many ips the services of a namespace may hold unless its "+
+			"lb.lambdahj.site/ip-quota annotation says otherwise, 0 means no limit.")
+	flag.IntVar(&maxConcurrentReconciles, "max-concurrent-reconciles", 1,
+		"How many services are reconciled at the same time.")
+	flag.BoolVar(&spreadPools, "spread-pools", false,
+		"Balance new ips across the pools of the same priority according to their weight "+
+			"instead of filling them one after the other.")
+	flag.StringVar(&rebuildPolicy, "rebuild-policy", controllers.RebuildKeepOldest,
+		"What happens at startup to services claiming the same ip and to ips outside of every pool: "+
+			"KeepOldest gives a shared ip to the oldest service and new ips to the others, Report only reports them, "+
+			"Reassign also gives new ips to the services of ips outside of every pool.")
+	flag.DurationVar(&gcInterval, "gc-interval", 10*time.Minute,
+		"How often ips still held for services which are gone are released, 0 disables the garbage collection.")
+	flag.DurationVar(&gcGrace, "gc-grace-period", time.Hour,
+		"How long the ips of a service have to be found without it before they are released, "+
+			"e.g. for the services of a restored snapshot to be recreated.")
+	flag.BoolVar(&snapshotImport, "enable-snapshot-import", false,
+		"Let the leader import snapshots posted to /ipam/snapshot of the metrics address.")
 	flag.Parse()
 
 	ctrl.SetLogger(zap.New(zap.UseDevMode(true)))
@@ -68,27 +128,246 @@ func main() {
 		os.Exit(1)
 	}
 
-	ctl := &controllers.BGPConfigReconciler{
-		Client: mgr.GetClient(),
-		Log:    ctrl.Log.WithName("controllers").WithName("BGPConfig"),
-		Scheme: mgr.GetScheme(),
-		Locker: sync.Mutex{},
+	store, err := ipam.NewStore(ipamStore, mgr.GetClient(), mgr.GetAPIReader(), ipamNamespace)
+	if err != nil {
+		setupLog.Error(err, "unable to create ipam store", "store", ipamStore)
+		os.Exit(1)
 	}
-	if err = ctl.Init(mgr.GetAPIReader()); err != nil {
 
-		setupLog.Error(err, "unable to init controller", "controller", "BGPConfig")
+	if drainPolicy != ipam.DrainKeep && drainPolicy != ipam.DrainMigrate {
+		setupLog.Error(fmt.Errorf("unknown drain policy %q", drainPolicy), "invalid flag")
 		os.Exit(1)
 	}
-	if err = ctl.SetupWithManager(mgr); err != nil {
-		setupLog.Error(err, "unable to create controller", "controller", "BGPConfig")
+	ipamManager := ipam.NewIPAMManager(store)
+	ipamManager.Quarantine = ipQuarantine
+	ipamManager.Retention = ipRetention
+	ipamManager.DrainPolicy = drainPolicy
+	ipamManager.Spread = spreadPools
+
+	ctl := &controllers.BGPConfigReconciler{
+		Client:                  mgr.GetClient(),
+		Log:                     ctrl.Log.WithName("controllers").WithName("BGPConfig"),
+		Scheme:                  mgr.GetScheme(),
+		IPAM:                    ipamManager,
+		Recorder:                mgr.GetEventRecorderFor("bgplb"),
+		ServiceCache:            mgr.GetCache(),
+		DefaultQuota:            namespaceQuota,
+		MaxConcurrentReconciles: maxConcurrentReconciles,
+		PoolNamespace:           ipamNamespace,
+		RebuildPolicy:           rebuildPolicy,
+	}
+	poolCtl := &controllers.BGPIPsConfigReconciler{
+		Client:        mgr.GetClient(),
+		Log:           ctrl.Log.WithName("controllers").WithName("BGPIPsConfig"),
+		Scheme:        mgr.GetScheme(),
+		IPAM:          ipamManager,
+		Recorder:      mgr.GetEventRecorderFor("bgplb"),
+		Services:      ctl,
+		PoolNamespace: ipamNamespace,
+	}
+	delegationCtl := &controllers.SubnetDelegationReconciler{
+		Client:   mgr.GetClient(),
+		Log:      ctrl.Log.WithName("controllers").WithName("SubnetDelegation"),
+		Scheme:   mgr.GetScheme(),
+		IPAM:     ipamManager,
+		Recorder: mgr.GetEventRecorderFor("bgplb"),
+		Services: ctl,
+	}
+	// The changes made before the controllers are set up are handed over to
+	// them once they are, OnChange is set before anything flushes.
+	ipamManager.OnChange = func(pool string) {
+		poolCtl.NotifyPoolChange(pool)
+		delegationCtl.NotifyPoolChange(pool)
+	}
+	// The controllers are set up once the leader restored the ipam.
+	setup := func(mgr ctrl.Manager) error {
+		if err := ctl.SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "BGPConfig")
+			return err
+		}
+		if err := poolCtl.SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "BGPIPsConfig")
+			return err
+		}
+		if err := delegationCtl.SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "SubnetDelegation")
+			return err
+		}
+		if err := (&controllers.CalicoConfigReconciler{
+			Client:   mgr.GetClient(),
+			Log:      ctrl.Log.WithName("controllers").WithName("CalicoConfig"),
+			Scheme:   mgr.GetScheme(),
+			IPAM:     ipamManager,
+			Services: ctl,
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "CalicoConfig")
+			return err
+		}
+
+		if err := (&controllers.ConflictReconciler{
+			Client:        mgr.GetClient(),
+			Log:           ctrl.Log.WithName("controllers").WithName("Conflict"),
+			Scheme:        mgr.GetScheme(),
+			IPAM:          ipamManager,
+			Recorder:      mgr.GetEventRecorderFor("bgplb"),
+			ServiceCidrs:  splitList(serviceCidrs),
+			PoolNamespace: ipamNamespace,
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "Conflict")
+			return err
+		}
+		// +kubebuilder:scaffold:builder
+
+		if gcInterval > 0 {
+			if err := mgr.Add(&controllers.GarbageCollector{
+				Client:        mgr.GetClient(),
+				Log:           ctrl.Log.WithName("gc"),
+				IPAM:          ipamManager,
+				Recorder:      mgr.GetEventRecorderFor("bgplb"),
+				Interval:      gcInterval,
+				PoolNamespace: ipamNamespace,
+				Grace:         gcGrace,
+			}); err != nil {
+				setupLog.Error(err, "unable to add garbage collector")
+				return err
+			}
+		}
+		return nil
+	}
+	initializer := &controllers.IPAMInitializer{
+		Manager:  mgr,
+		Log:      ctrl.Log.WithName("init"),
+		Services: ctl,
+		Setup:    setup,
+	}
+	if err = mgr.Add(initializer); err != nil {
+		setupLog.Error(err, "unable to add ipam initializer")
 		os.Exit(1)
 	}
 
-	// +kubebuilder:scaffold:builder
+	if err = mgr.AddMetricsExtraHandler("/ipam/snapshot", &controllers.SnapshotHandler{
+		Client:        mgr.GetClient(),
+		Log:           ctrl.Log.WithName("snapshot"),
+		IPAM:          ipamManager,
+		PoolNamespace: ipamNamespace,
+		Import:        snapshotImport,
+		Ready:         initializer.Ready,
+	}); err != nil {
+		setupLog.Error(err, "unable to serve ipam snapshot")
+		os.Exit(1)
+	}
 
 	setupLog.Info("starting manager")
 	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
 		setupLog.Error(err, "problem running manager")
 		os.Exit(1)
 	}
+	// Allocations are saved in the background, write the last ones.
+	if err := ipamManager.Flush(); err != nil {
+		setupLog.Error(err, "unable to save ipam")
+		os.Exit(1)
+	}
+}
+
+// splitList splits a comma separated flag value, dropping empty entries.
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+const snapshotUsage = `Usage: manager snapshot export|import [flags]
+
+Export writes the ipam state persisted in the cluster as json without
+changing it, import restores such a snapshot. Run them while the manager
+is stopped, the leader of a running manager serves the same snapshot on
+GET /ipam/snapshot of its metrics address, and imports one on POST when
+started with --enable-snapshot-import.
+
+Flags:
+`
+
+// runSnapshot implements the snapshot subcommand.
+func runSnapshot(args []string) error {
+	fs := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), snapshotUsage)
+		fs.PrintDefaults()
+	}
+	ipamStore := fs.String("ipam-store", ipam.StoreCRD,
+		"Where ip allocations are persisted, one of crd or configmap.")
+	ipamNamespace := fs.String("ipam-namespace", "bgplb-system",
+		"The namespace of the BGPIPsConfigs, and of the ConfigMaps used by the configmap ipam store.")
+	file := fs.String("f", "-", "The snapshot file, - for stdout or stdin.")
+	if kubeconfig := flag.Lookup("kubeconfig"); kubeconfig != nil {
+		fs.Var(kubeconfig.Value, kubeconfig.Name, kubeconfig.Usage)
+	}
+	if len(args) == 0 || (args[0] != "export" && args[0] != "import") {
+		fs.Usage()
+		return fmt.Errorf("expected export or import")
+	}
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	// The memory store has nothing to export and forgets what is imported.
+	if *ipamStore == ipam.StoreMemory {
+		return fmt.Errorf("the %s ipam store cannot be snapshotted, use crd or configmap", ipam.StoreMemory)
+	}
+
+	c, err := client.New(ctrl.GetConfigOrDie(), client.Options{Scheme: scheme})
+	if err != nil {
+		return err
+	}
+	store, err := ipam.NewStore(*ipamStore, c, c, *ipamNamespace)
+	if err != nil {
+		return err
+	}
+	// Export only reads the state, restoring the pools writes it back.
+	if args[0] == "export" {
+		store = ipam.ReadOnlyStore{Store: store}
+	}
+	ipamManager := ipam.NewIPAMManager(store)
+	if err := (&controllers.BGPConfigReconciler{
+		Client:        c,
+		Log:           ctrl.Log.WithName("snapshot"),
+		Scheme:        scheme,
+		IPAM:          ipamManager,
+		PoolNamespace: *ipamNamespace,
+	}).LoadPools(c); err != nil {
+		return err
+	}
+
+	if args[0] == "export" {
+		var w io.Writer = os.Stdout
+		if *file != "-" {
+			f, err := os.Create(*file)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(ipamManager.Export())
+	}
+
+	var r io.Reader = os.Stdin
+	if *file != "-" {
+		f, err := os.Open(*file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	snapshot, err := controllers.ReadSnapshot(r)
+	if err != nil {
+		return err
+	}
+	return controllers.RestoreSnapshot(context.Background(), c, *ipamNamespace, ipamManager, snapshot)
 }
@@ -0,0 +1,108 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipam
+
+import (
+	"context"
+	"encoding/json"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	configMapPrefix = "ipam-"
+	configMapKey    = "state"
+	// ConfigMapLabel marks the ConfigMaps written by ConfigMapStore.
+	ConfigMapLabel = "lb.lambdahj.site/ipam"
+)
+
+// ConfigMapStore persists allocations into ConfigMaps, one per pool, with
+// the state stored as json.
+type ConfigMapStore struct {
+	client    client.Client
+	reader    client.Reader
+	namespace string
+}
+
+func NewConfigMapStore(c client.Client, reader client.Reader, namespace string) *ConfigMapStore {
+	return &ConfigMapStore{client: c, reader: reader, namespace: namespace}
+}
+
+func (s *ConfigMapStore) key(name string) types.NamespacedName {
+	return types.NamespacedName{Namespace: s.namespace, Name: configMapPrefix + name}
+}
+
+func (s *ConfigMapStore) Load(name string) (*PoolState, error) {
+	cm := &corev1.ConfigMap{}
+	err := s.reader.Get(context.Background(), s.key(name), cm)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return newPoolState(name), nil
+		}
+		return nil, err
+	}
+	data, ok := cm.Data[configMapKey]
+	if !ok {
+		return newPoolState(name), nil
+	}
+	state := newPoolState(name)
+	if err := json.Unmarshal([]byte(data), state); err != nil {
+		return nil, err
+	}
+	if state.Allocations == nil {
+		state.Allocations = make(map[string]*Allocation)
+	}
+	if state.Released == nil {
+		state.Released = make(map[string]Release)
+	}
+	return state, nil
+}
+
+func (s *ConfigMapStore) Save(state *PoolState) error {
+	ctx := context.Background()
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm := &corev1.ConfigMap{}
+		err := s.reader.Get(ctx, s.key(state.Name), cm)
+		if err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+		cm.Data = map[string]string{configMapKey: string(data)}
+		if err != nil {
+			cm.Namespace = s.namespace
+			cm.Name = s.key(state.Name).Name
+			cm.Labels = map[string]string{ConfigMapLabel: "true"}
+			return s.client.Create(ctx, cm)
+		}
+		return s.client.Update(ctx, cm)
+	})
+}
+
+func (s *ConfigMapStore) Delete(name string) error {
+	cm := &corev1.ConfigMap{}
+	cm.Namespace = s.namespace
+	cm.Name = s.key(name).Name
+	return client.IgnoreNotFound(s.client.Delete(context.Background(), cm))
+}
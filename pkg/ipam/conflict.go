@@ -0,0 +1,92 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipam
+
+import (
+	"fmt"
+	"net"
+	"sort"
+)
+
+// Reserve replaces the addresses used outside of the ipam, such as node or
+// pod addresses, which no pool hands out. reservations maps a source, e.g.
+// node/worker-1, to its addresses, each a single ip, a cidr or an inclusive
+// range. Reserve returns the names of the pools whose conflicts changed.
+func (im *IPAMManager) Reserve(reservations map[string][]string) ([]string, error) {
+	parsed := make(map[string][]ipRange, len(reservations))
+	var reserved ipSet
+	for source, ranges := range reservations {
+		for _, s := range ranges {
+			r, err := parseRange(s)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", source, err)
+			}
+			parsed[source] = append(parsed[source], r)
+			reserved.add(r)
+		}
+	}
+
+	im.lock.Lock()
+	defer im.lock.Unlock()
+
+	before := make(map[string][]string, len(im.pools))
+	for _, p := range im.pools {
+		before[p.Name] = im.conflicts(p)
+	}
+	im.reservations = parsed
+	im.reservedIPs = reserved
+	var changed []string
+	for _, p := range im.pools {
+		if !equalStrings(before[p.Name], im.conflicts(p)) {
+			changed = append(changed, p.Name)
+			if im.OnChange != nil {
+				im.OnChange(p.Name)
+			}
+		}
+	}
+	return changed, nil
+}
+
+// conflicts returns the reservations overlapping p, sorted.
+func (im *IPAMManager) conflicts(p *pool) []string {
+	var out []string
+	for source, ranges := range im.reservations {
+		for _, r := range ranges {
+			if p.overlaps(r) {
+				out = append(out, source+" "+r.String())
+			}
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// reserved reports whether ip is used outside of the ipam.
+func (im *IPAMManager) reserved(ip net.IP) bool {
+	_, ok := im.reservedIPs.covering(ip)
+	return ok
+}
+
+// overlappingPool returns the pool other than p sharing addresses with p.
+func (im *IPAMManager) overlappingPool(p *pool) *pool {
+	for _, prefix := range p.prefixes {
+		if other := im.prefixes.overlapping(prefix); other != nil && other.Name != p.Name {
+			return other
+		}
+	}
+	return nil
+}
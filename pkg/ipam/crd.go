@@ -0,0 +1,164 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipam
+
+import (
+	"context"
+	"sort"
+
+	"github.com/LambdaHJ/bgplb/api/v1beta1"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// CalicoPoolLabel marks the BGPIPsConfigs of the Calico pools. They only
+// hold the state and the status of their pool, which is described by the
+// Calico BGPConfiguration, and go away together with it.
+const CalicoPoolLabel = "lb.lambdahj.site/calico-pool"
+
+// IsCalicoConfig reports whether conf holds the state and the status of a
+// Calico pool rather than describing a pool, which is told by
+// CalicoPoolLabel only.
+func IsCalicoConfig(conf *v1beta1.BGPIPsConfig) bool {
+	return conf.Labels[CalicoPoolLabel] == "true"
+}
+
+// CRDStore persists allocations into BGPIPsConfig objects, one per pool,
+// which live in a single namespace.
+type CRDStore struct {
+	client    client.Client
+	reader    client.Reader
+	namespace string
+}
+
+// NewCRDStore returns a CRDStore for the BGPIPsConfigs of namespace. Reads go
+// through reader so that the store can be used before the manager cache is
+// started.
+func NewCRDStore(c client.Client, reader client.Reader, namespace string) *CRDStore {
+	return &CRDStore{client: c, reader: reader, namespace: namespace}
+}
+
+func (s *CRDStore) key(name string) types.NamespacedName {
+	return types.NamespacedName{Namespace: s.namespace, Name: name}
+}
+
+func (s *CRDStore) Load(name string) (*PoolState, error) {
+	state := newPoolState(name)
+	conf := &v1beta1.BGPIPsConfig{}
+	err := s.reader.Get(context.Background(), s.key(name), conf)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return state, nil
+		}
+		return nil, err
+	}
+	state.Cidr = conf.Spec.Cidr
+	state.Free = conf.Spec.Free
+	// The ips recorded by earlier versions have no holders, they are
+	// restored from the services and dropped by the next Save.
+	if conf.Spec.IPItems == nil {
+		return state, nil
+	}
+	for _, released := range conf.Spec.IPItems.Released {
+		state.Released[released.IP] = Release{Owner: released.Owner, At: released.Time.Time}
+	}
+	for _, item := range conf.Spec.IPItems.Items {
+		alloc, ok := state.Allocations[item.IP]
+		if !ok {
+			alloc = &Allocation{SharingKey: item.SharingKey, Owners: make(map[string][]string)}
+			state.Allocations[item.IP] = alloc
+		}
+		alloc.Owners[item.Owner] = item.Ports
+	}
+	return state, nil
+}
+
+// Save records state into the BGPIPsConfig of its pool, creating it if it
+// does not exist yet. The BGPIPsConfigs of Calico pools are labeled with
+// CalicoPoolLabel.
+func (s *CRDStore) Save(state *PoolState) error {
+	ctx := context.Background()
+	items := &v1beta1.IPItemList{Items: make([]v1beta1.IPItem, 0, len(state.Allocations))}
+	for ip, alloc := range state.Allocations {
+		for owner, ports := range alloc.Owners {
+			items.Items = append(items.Items, v1beta1.IPItem{
+				IP:         ip,
+				Owner:      owner,
+				SharingKey: alloc.SharingKey,
+				Ports:      ports,
+			})
+		}
+	}
+	sort.Slice(items.Items, func(i, j int) bool {
+		if items.Items[i].IP != items.Items[j].IP {
+			return items.Items[i].IP < items.Items[j].IP
+		}
+		return items.Items[i].Owner < items.Items[j].Owner
+	})
+	for ip, release := range state.Released {
+		items.Released = append(items.Released, v1beta1.ReleasedIP{
+			IP:    ip,
+			Owner: release.Owner,
+			Time:  metav1.NewTime(release.At),
+		})
+	}
+	sort.Slice(items.Released, func(i, j int) bool {
+		return items.Released[i].IP < items.Released[j].IP
+	})
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		conf := &v1beta1.BGPIPsConfig{}
+		err := s.reader.Get(ctx, s.key(state.Name), conf)
+		if err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+		conf.Spec.Free = state.Free
+		conf.Spec.Used = uint(len(state.Allocations))
+		conf.Spec.IPItems = items
+		if state.FromCalico {
+			if conf.Labels == nil {
+				conf.Labels = make(map[string]string)
+			}
+			conf.Labels[CalicoPoolLabel] = "true"
+		}
+		if err != nil {
+			conf.Name = state.Name
+			conf.Namespace = s.namespace
+			conf.Spec.Cidr = state.Cidr
+			return s.client.Create(ctx, conf)
+		}
+		return s.client.Update(ctx, conf)
+	})
+}
+
+// Delete removes the BGPIPsConfig of a Calico pool. The state of other
+// pools goes away together with their BGPIPsConfig.
+func (s *CRDStore) Delete(name string) error {
+	ctx := context.Background()
+	conf := &v1beta1.BGPIPsConfig{}
+	if err := s.reader.Get(ctx, s.key(name), conf); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	if !IsCalicoConfig(conf) {
+		return nil
+	}
+	return client.IgnoreNotFound(s.client.Delete(ctx, conf))
+}
@@ -0,0 +1,402 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipam
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/LambdaHJ/bgplb/api/v1beta1"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Delegation sets a block of a pool aside for the services of a namespace.
+// A namespace with delegations gets the ips of a family from its delegated
+// blocks only, and no other namespace gets ips from them.
+type Delegation struct {
+	Name      string
+	Pool      string
+	Namespace string
+	// Cidr is the block to delegate, it must be part of a single cidr or
+	// range of the pool.
+	Cidr string
+	// PrefixLength picks the first free block of that length when Cidr is
+	// unset.
+	PrefixLength int
+}
+
+// DelegationFromObject returns the Delegation described by d. The subnet in
+// the status of d is kept as long as it matches the spec, so that the block
+// stays the same across restarts.
+func DelegationFromObject(d *v1beta1.SubnetDelegation) *Delegation {
+	delegation := &Delegation{
+		Name:         d.Name,
+		Pool:         d.Spec.Pool,
+		Namespace:    d.Spec.Namespace,
+		Cidr:         d.Spec.Cidr,
+		PrefixLength: d.Spec.PrefixLength,
+	}
+	if delegation.Cidr == "" && d.Status.Cidr != "" {
+		if _, ipnet, err := net.ParseCIDR(d.Status.Cidr); err == nil {
+			if ones, _ := ipnet.Mask.Size(); ones == d.Spec.PrefixLength {
+				delegation.Cidr = d.Status.Cidr
+			}
+		}
+	}
+	return delegation
+}
+
+// DelegationStatus is a snapshot of the utilization of a delegated block.
+type DelegationStatus struct {
+	Pool      string
+	Namespace string
+	Cidr      string
+	Total     uint
+	Used      uint
+	Free      uint
+}
+
+// delegation is a block of a pool set aside for namespace.
+type delegation struct {
+	name      string
+	namespace string
+	block     ipRange
+	cidr      string
+}
+
+// Delegate sets the block described by d aside for d.Namespace and returns
+// its cidr. Delegating again under the same name keeps the block as long as
+// it still matches d, a changed d moves the delegation to a new block.
+//
+// The blocks are enforced by the manager, their ips stay allocations of the
+// pool.
+func (im *IPAMManager) Delegate(d *Delegation) (string, error) {
+	im.lock.Lock()
+	defer im.lock.Unlock()
+
+	p := im.getPool(d.Pool)
+	if p == nil {
+		return "", fmt.Errorf("pool %s not found", d.Pool)
+	}
+	if p.draining {
+		return "", fmt.Errorf("pool %s is being removed", d.Pool)
+	}
+	owner, existing := im.getDelegation(d.Name)
+	if existing != nil {
+		if owner == p && existing.namespace == d.Namespace &&
+			(d.Cidr == "" && (d.PrefixLength == 0 || d.PrefixLength == existing.prefixLength()) || d.Cidr == existing.cidr) {
+			return existing.cidr, nil
+		}
+		owner.undelegate(d.Name)
+	}
+
+	added, err := p.delegate(d)
+	if err != nil {
+		if existing != nil {
+			owner.delegations = append(owner.delegations, existing)
+		}
+		return "", err
+	}
+	return added.cidr, nil
+}
+
+// Undelegate gives the block delegated under name back to its pool. The ips
+// acquired from it are kept by their holders.
+func (im *IPAMManager) Undelegate(name string) {
+	im.lock.Lock()
+	defer im.lock.Unlock()
+
+	if p, _ := im.getDelegation(name); p != nil {
+		p.undelegate(name)
+	}
+}
+
+// DelegationStatus returns the utilization of the block delegated under
+// name, or nil if there is no such delegation.
+func (im *IPAMManager) DelegationStatus(name string) *DelegationStatus {
+	im.lock.RLock()
+	defer im.lock.RUnlock()
+
+	p, d := im.getDelegation(name)
+	if d == nil {
+		return nil
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	total := d.block.size()
+	total.Sub(total, d.block.overlapSize(p.reserved))
+	used := 0
+	for ip := range p.state.Allocations {
+		if d.block.contains(net.ParseIP(ip)) {
+			used++
+		}
+	}
+	free := new(big.Int).Sub(total, big.NewInt(int64(used)))
+	return &DelegationStatus{
+		Pool:      p.Name,
+		Namespace: d.namespace,
+		Cidr:      d.cidr,
+		Total:     clampUint(total),
+		Used:      uint(used),
+		Free:      clampUint(free),
+	}
+}
+
+func (im *IPAMManager) getDelegation(name string) (*pool, *delegation) {
+	for _, p := range im.pools {
+		for _, d := range p.delegations {
+			if d.name == name {
+				return p, d
+			}
+		}
+	}
+	return nil, nil
+}
+
+// scope returns what the services of the namespace of owner may acquire in
+// the pools of family.
+func (im *IPAMManager) scope(owner string, family corev1.IPFamily) scope {
+	s := scope{namespace: strings.SplitN(owner, "/", 2)[0]}
+	for _, p := range im.pools {
+		if len(p.delegations) == 0 || p.family() != family {
+			continue
+		}
+		for _, d := range p.delegations {
+			if d.namespace != s.namespace {
+				continue
+			}
+			if s.blocks == nil {
+				s.blocks = make(map[*pool][]ipRange)
+			}
+			s.blocks[p] = append(s.blocks[p], d.block)
+		}
+	}
+	return s
+}
+
+// scope is what the services of a namespace may acquire.
+type scope struct {
+	namespace string
+	// blocks are the blocks delegated to namespace by pool, nil if it has
+	// none in the family asked for.
+	blocks map[*pool][]ipRange
+}
+
+// allows reports whether ip of p may be handed to the services of the
+// namespace of s.
+func (s scope) allows(p *pool, ip net.IP) bool {
+	if s.blocks != nil {
+		for _, block := range s.blocks[p] {
+			if block.contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	d := p.delegationOf(ip)
+	return d == nil || d.namespace == s.namespace
+}
+
+// restrict returns the pools of s among pools, in order, or pools if the
+// namespace of s has no delegations.
+func (s scope) restrict(pools []*pool) []*pool {
+	if s.blocks == nil {
+		return pools
+	}
+	restricted := make([]*pool, 0, len(s.blocks))
+	for _, p := range pools {
+		if _, ok := s.blocks[p]; ok {
+			restricted = append(restricted, p)
+		}
+	}
+	return restricted
+}
+
+// view returns p limited to the blocks of s, which lets nextFree look at
+// those addresses only. The view shares its state with p.
+func (s scope) view(p *pool) *pool {
+	blocks, ok := s.blocks[p]
+	if !ok {
+		return p
+	}
+	return &pool{
+		Pool:     p.Pool,
+		spans:    blocks,
+		prefixes: p.prefixes,
+		reserved: p.reserved,
+		state:    p.state,
+		held:     p.held,
+		rand:     p.rand,
+	}
+}
+
+// delegationOf returns the delegation of p holding ip, or nil.
+func (p *pool) delegationOf(ip net.IP) *delegation {
+	for _, d := range p.delegations {
+		if d.block.contains(ip) {
+			return d
+		}
+	}
+	return nil
+}
+
+// delegate adds the delegation described by d to p.
+func (p *pool) delegate(d *Delegation) (*delegation, error) {
+	var block ipRange
+	if d.Cidr != "" {
+		_, ipnet, err := net.ParseCIDR(d.Cidr)
+		if err != nil {
+			return nil, err
+		}
+		block = cidrRange(ipnet)
+		if !p.withinSpan(block) {
+			return nil, fmt.Errorf("%s is not part of a single range of pool %s", ipnet, p.Name)
+		}
+		if other := p.blocking(block, d.Namespace); other != "" {
+			return nil, fmt.Errorf("%s overlaps %s", ipnet, other)
+		}
+	} else {
+		bits := len(p.spans[0].first) * 8
+		if d.PrefixLength == 0 {
+			return nil, fmt.Errorf("delegation %s has neither cidr nor prefix length", d.Name)
+		}
+		if d.PrefixLength < 1 || d.PrefixLength > bits {
+			return nil, fmt.Errorf("invalid prefix length %d for pool %s", d.PrefixLength, p.Name)
+		}
+		var ok bool
+		if block, ok = p.freeBlock(d.PrefixLength, d.Namespace); !ok {
+			return nil, fmt.Errorf("pool %s has no free /%d left", p.Name, d.PrefixLength)
+		}
+	}
+
+	added := &delegation{
+		name:      d.Name,
+		namespace: d.Namespace,
+		block:     block,
+		cidr:      block.cidrs()[0].String(),
+	}
+	p.delegations = append(p.delegations, added)
+	return added, nil
+}
+
+func (p *pool) undelegate(name string) {
+	for i, d := range p.delegations {
+		if d.name == name {
+			p.delegations = append(p.delegations[:i], p.delegations[i+1:]...)
+			return
+		}
+	}
+}
+
+// withinSpan reports whether block is part of a single span of p.
+func (p *pool) withinSpan(block ipRange) bool {
+	for _, span := range p.spans {
+		if span.contains(block.first) && span.contains(block.last) {
+			return true
+		}
+	}
+	return false
+}
+
+// taken returns the addresses of p which cannot be delegated to namespace:
+// the blocks of other delegations and the ips held by services of other
+// namespaces, sorted.
+func (p *pool) taken(namespace string) []ipRange {
+	var taken []ipRange
+	for _, d := range p.delegations {
+		taken = append(taken, d.block)
+	}
+	for ip, alloc := range p.state.Allocations {
+		for owner := range alloc.Owners {
+			if !strings.HasPrefix(owner, namespace+"/") {
+				parsed := normalize(net.ParseIP(ip))
+				taken = append(taken, ipRange{first: parsed, last: parsed})
+				break
+			}
+		}
+	}
+	sort.Slice(taken, func(i, j int) bool {
+		return ipToInt(taken[i].first).Cmp(ipToInt(taken[j].first)) < 0
+	})
+	return taken
+}
+
+// blocking describes what keeps block from being delegated to namespace, or
+// returns "".
+func (p *pool) blocking(block ipRange, namespace string) string {
+	for _, d := range p.delegations {
+		if d.block.overlapSize([]ipRange{block}).Sign() > 0 {
+			return "delegation " + d.name
+		}
+	}
+	for _, r := range p.taken(namespace) {
+		if block.contains(r.first) {
+			return "ip " + r.first.String() + " held by another namespace"
+		}
+	}
+	return ""
+}
+
+// freeBlock returns the first aligned block of the given prefix length
+// within a span of p which can be delegated to namespace.
+func (p *pool) freeBlock(prefixLength int, namespace string) (ipRange, bool) {
+	bits := len(p.spans[0].first) * 8
+	size := new(big.Int).Lsh(big.NewInt(1), uint(bits-prefixLength))
+	taken := p.taken(namespace)
+	for _, span := range p.spans {
+		end := ipToInt(span.last)
+		cursor := alignUp(ipToInt(span.first), size)
+		for _, r := range taken {
+			if ipToInt(r.last).Cmp(cursor) < 0 {
+				continue
+			}
+			last := new(big.Int).Add(cursor, size)
+			last.Sub(last, big.NewInt(1))
+			if last.Cmp(ipToInt(r.first)) < 0 {
+				break
+			}
+			cursor = alignUp(new(big.Int).Add(ipToInt(r.last), big.NewInt(1)), size)
+		}
+		last := new(big.Int).Add(cursor, size)
+		last.Sub(last, big.NewInt(1))
+		if last.Cmp(end) <= 0 {
+			return ipRange{first: intToIP(cursor, len(span.first)), last: intToIP(last, len(span.first))}, true
+		}
+	}
+	return ipRange{}, false
+}
+
+// prefixLength returns the prefix length of the block of d.
+func (d *delegation) prefixLength() int {
+	_, ipnet, _ := net.ParseCIDR(d.cidr)
+	ones, _ := ipnet.Mask.Size()
+	return ones
+}
+
+// alignUp returns the first multiple of size not below n.
+func alignUp(n, size *big.Int) *big.Int {
+	rem := new(big.Int).Mod(n, size)
+	if rem.Sign() == 0 {
+		return n
+	}
+	return new(big.Int).Add(n, rem.Sub(size, rem))
+}
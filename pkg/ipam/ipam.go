@@ -18,88 +18,1042 @@ package ipam
 
 import (
 	"errors"
+	"fmt"
+	"math/rand"
 	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
-	goipam "github.com/metal-stack/go-ipam"
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
 )
 
+// ErrPoolInUse is returned when removing a pool which still has allocations.
+var ErrPoolInUse = errors.New("pool still has allocations")
+
+var (
+	log = logf.Log.WithName("ipam")
+
+	saveFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bgplb_ipam_save_failures_total",
+		Help: "Number of times the allocations of a pool failed to be written to the ipam store, by pool.",
+	}, []string{"pool"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(saveFailures)
+}
+
+// releasedHistory is how long the pools with StrategyLeastRecentlyReleased
+// remember the release of an ip at least. The ips released before are
+// handed out like never used ones, which are still the first.
+const releasedHistory = 7 * 24 * time.Hour
+
+// flushRetry is how long the background flush waits before it retries the
+// pools it failed to save.
+const flushRetry = time.Second
+
+// IPAMManager is safe for concurrent use.
 type IPAMManager struct {
-	ipam     goipam.Ipamer
-	cidrs    []string
-	cidrList []*net.IPNet
+	// Quarantine keeps released ips from being handed out again for the
+	// given duration, it must be set before the manager is used.
+	Quarantine time.Duration
+	// Retention is how long a released ip is remembered for its last owner,
+	// which gets it back in preference to any other ip when it asks again.
+	// Other owners only get it once nothing else is free.
+	Retention time.Duration
+
+	// lock guards the pools and the reservations. Adding, updating and
+	// removing pools write locks it, everything else read locks it and then
+	// locks the pools it works on, one at a time.
+	lock sync.RWMutex
+	// pools are sorted by priority, pools of the same priority are tried in
+	// the order they were added.
+	pools []*pool
+	// prefixes maps the cidrs of every pool to the pool.
+	prefixes *prefixTrie
+	store    Store
+	// reservations are the addresses used outside of the ipam, by source,
+	// reservedIPs merges them for lookups.
+	reservations map[string][]ipRange
+	reservedIPs  ipSet
+	// DrainPolicy applies to the pools without a DrainPolicy of their own,
+	// DrainKeep if unset.
+	DrainPolicy string
+	// Spread balances new ips across the pools of the same priority
+	// according to their weight instead of filling them one after the other,
+	// it must be set before the manager is used.
+	Spread bool
+	// OnChange, when set, is called with the name of a pool after its
+	// allocations were persisted, once it is removed from the store, or when
+	// its conflicts changed. It must not block.
+	OnChange func(pool string)
+
+	// dirty are the names of the pools changed since they were last saved.
+	// They are written in the background by Flush, which keeps store calls
+	// out of the locks and batches the changes made while a save is under
+	// way. flushing is set while the background flush runs, saving
+	// serializes the flushes. batches counts the Batch calls under way,
+	// which hold the background flush back.
+	dirtyLock sync.Mutex
+	dirty     map[string]bool
+	flushing  bool
+	batches   int
+	saving    sync.Mutex
+
+	// rand seeds the random source of the pools with StrategyRandom.
+	rand *rand.Rand
+	now  func() time.Time
 }
 
-func NewIPAMManager() *IPAMManager {
-	i := goipam.New()
-	m := make([]string, 0)
-	cidrList := make([]*net.IPNet, 0)
-	return &IPAMManager{ipam: i, cidrs: m, cidrList: cidrList}
+func NewIPAMManager(store Store) *IPAMManager {
+	pools := make([]*pool, 0)
+	return &IPAMManager{
+		pools:    pools,
+		prefixes: newPrefixTrie(),
+		store:    store,
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+		now:      time.Now,
+	}
 }
 
+// NewCidr adds a pool for cidr unless a pool of the same cidr exists. A
+// draining pool of the Calico BGPConfiguration is put back in use.
 func (im *IPAMManager) NewCidr(cidr string) error {
-	_, ipnet, err := net.ParseCIDR(cidr)
+	im.lock.Lock()
+	defer im.lock.Unlock()
+
+	for _, p := range im.pools {
+		if p.Cidr == cidr {
+			if p.FromCalico {
+				p.draining = false
+			}
+			return nil
+		}
+	}
+	return im.addPool(&Pool{Name: PoolName(cidr), Cidr: cidr, FromCalico: true})
+}
+
+// AddPool adds p and restores the allocations persisted for it.
+func (im *IPAMManager) AddPool(p *Pool) error {
+	im.lock.Lock()
+	defer im.lock.Unlock()
+
+	return im.addPool(p)
+}
+
+func (im *IPAMManager) addPool(p *Pool) error {
+	added, err := im.checkPool(p)
 	if err != nil {
 		return err
 	}
-	_, err = im.ipam.NewPrefix(cidr)
+	// A pool removed since the last flush still has its stale state in the
+	// store.
+	saved := newPoolState(p.Name)
+	if !im.isDirty(p.Name) {
+		if saved, err = im.store.Load(p.Name); err != nil {
+			return err
+		}
+	}
+	im.insertNewPool(added, saved)
+	return nil
+}
+
+// checkPool returns the pool described by p unless it cannot be added.
+func (im *IPAMManager) checkPool(p *Pool) (*pool, error) {
+	if im.getPool(p.Name) != nil {
+		return nil, fmt.Errorf("pool %s already exists", p.Name)
+	}
+	added, err := newPool(p)
+	if err != nil {
+		return nil, err
+	}
+	if other := im.overlappingPool(added); other != nil {
+		return nil, fmt.Errorf("pool %s overlaps pool %s", p.Name, other.Name)
+	}
+	return added, nil
+}
+
+// insertNewPool adds the pool checked by checkPool with the allocations and
+// released ips of saved which are part of it.
+func (im *IPAMManager) insertNewPool(added *pool, saved *PoolState) {
+	if added.Strategy == StrategyRandom {
+		added.rand = rand.New(rand.NewSource(im.rand.Int63()))
+	}
+	added.state = newPoolState(added.Name)
+	added.state.Cidr = added.Cidr
+	for ip, alloc := range saved.Allocations {
+		if added.prefixOf(ip) == "" {
+			continue
+		}
+		added.state.Allocations[ip] = alloc
+		added.held.add(single(net.ParseIP(ip)))
+	}
+	for ip, release := range saved.Released {
+		if _, held := added.state.Allocations[ip]; !held && added.prefixOf(ip) != "" {
+			added.state.Released[ip] = release
+		}
+	}
+	im.insertPool(added)
+	for _, prefix := range added.prefixes {
+		im.prefixes.insert(prefix, added)
+	}
+	im.persist(added)
+}
+
+// UpdatePool replaces the definition of the pool named p.Name. The cidr and
+// the ranges of a pool can only be changed while it has no allocations.
+func (im *IPAMManager) UpdatePool(p *Pool) error {
+	im.lock.Lock()
+	defer im.lock.Unlock()
+
+	existing := im.getPool(p.Name)
+	if existing == nil {
+		return im.addPool(p)
+	}
+	// The BGPIPsConfig written by the crd store for a Calico cidr does not
+	// make it any less a Calico pool.
+	p.FromCalico = p.FromCalico || existing.FromCalico
+	if existing.Cidr != p.Cidr || !equalStrings(existing.Ranges, p.Ranges) {
+		if err := im.removePool(p.Name); err != nil {
+			return err
+		}
+		if err := im.addPool(p); err != nil {
+			return err
+		}
+		// Delegations outside of the new cidr and ranges are dropped.
+		added := im.getPool(p.Name)
+		for _, d := range existing.delegations {
+			_, _ = added.delegate(&Delegation{Name: d.name, Namespace: d.namespace, Cidr: d.cidr})
+		}
+		return nil
+	}
+	updated, err := newPool(p)
 	if err != nil {
 		return err
 	}
-	im.cidrList = append(im.cidrList, ipnet)
-	im.cidrs = append(im.cidrs, cidr)
+	updated.state = existing.state
+	updated.held = existing.held
+	updated.rand = existing.rand
+	if updated.rand == nil && updated.Strategy == StrategyRandom {
+		updated.rand = rand.New(rand.NewSource(im.rand.Int63()))
+	}
+	updated.draining = existing.draining
+	updated.delegations = existing.delegations
+	for i := range im.pools {
+		if im.pools[i] == existing {
+			im.pools[i] = updated
+			if updated.Priority != existing.Priority {
+				im.pools = append(im.pools[:i], im.pools[i+1:]...)
+				im.insertPool(updated)
+			}
+			break
+		}
+	}
+	for _, prefix := range updated.prefixes {
+		im.prefixes.insert(prefix, updated)
+	}
+	if updated.free() != updated.state.Free {
+		im.persist(updated)
+	}
 	return nil
 }
 
-func (im *IPAMManager) AddUsedIP(ip string) bool {
-	if cidr := im.getCidrOfIP(ip); cidr != "" {
-		im.ipam.AcquireSpecificIP(cidr, ip)
-		return true
+// RemovePool removes the pool name. While the pool has allocations it fails
+// with ErrPoolInUse and drains instead: it hands out no more ips and is
+// removed together with its last allocation.
+func (im *IPAMManager) RemovePool(name string) error {
+	im.lock.Lock()
+	defer im.lock.Unlock()
+
+	err := im.removePool(name)
+	if err == ErrPoolInUse {
+		im.getPool(name).draining = true
+	}
+	return err
+}
+
+// CalicoPools returns the pools added for the cidrs of the Calico
+// BGPConfiguration.
+func (im *IPAMManager) CalicoPools() []Pool {
+	im.lock.RLock()
+	defer im.lock.RUnlock()
+
+	var pools []Pool
+	for _, p := range im.pools {
+		if p.FromCalico {
+			pools = append(pools, *p.Pool)
+		}
+	}
+	return pools
+}
+
+// Migrating reports whether ip belongs to a draining pool whose services
+// are to be moved to other pools.
+func (im *IPAMManager) Migrating(ip string) bool {
+	im.lock.RLock()
+	defer im.lock.RUnlock()
+
+	p := im.getPoolOfIP(ip)
+	return p != nil && p.draining && im.drainPolicy(p) == DrainMigrate
+}
+
+func (im *IPAMManager) removePool(name string) error {
+	for i, p := range im.pools {
+		if p.Name != name {
+			continue
+		}
+		if len(p.state.Allocations) > 0 {
+			return ErrPoolInUse
+		}
+		for _, prefix := range p.prefixes {
+			im.prefixes.remove(prefix)
+		}
+		im.pools = append(im.pools[:i], im.pools[i+1:]...)
+		// Flush deletes the state of the pools which are gone.
+		im.markDirty(name)
+		return nil
+	}
+	return nil
+}
+
+// HasPool reports whether the pool name exists.
+func (im *IPAMManager) HasPool(name string) bool {
+	im.lock.RLock()
+	defer im.lock.RUnlock()
+
+	return im.getPool(name) != nil
+}
+
+// IsCalicoPool reports whether the pool name was added for a cidr of the
+// Calico BGPConfiguration.
+func (im *IPAMManager) IsCalicoPool(name string) bool {
+	im.lock.RLock()
+	defer im.lock.RUnlock()
+
+	p := im.getPool(name)
+	return p != nil && p.FromCalico
+}
+
+// PoolStatus is a snapshot of the utilization of a pool.
+type PoolStatus struct {
+	Total uint
+	Used  uint
+	Free  uint
+	// Draining is set while the pool waits for its last allocations to go
+	// away before being removed.
+	Draining bool
+	// Conflicts lists the addresses used outside of the ipam which overlap
+	// the pool, as "source range".
+	Conflicts []string
+	// Allocations maps every acquired ip to its sorted holders.
+	Allocations map[string][]string
+}
+
+// Status returns the utilization of the pool name, or nil if there is no
+// such pool.
+func (im *IPAMManager) Status(name string) *PoolStatus {
+	im.lock.RLock()
+	defer im.lock.RUnlock()
+
+	p := im.getPool(name)
+	if p == nil {
+		return nil
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	status := &PoolStatus{
+		Total:       clampUint(p.total()),
+		Used:        uint(len(p.state.Allocations)),
+		Free:        p.free(),
+		Draining:    p.draining,
+		Conflicts:   im.conflicts(p),
+		Allocations: make(map[string][]string, len(p.state.Allocations)),
+	}
+	for ip, alloc := range p.state.Allocations {
+		owners := make([]string, 0, len(alloc.Owners))
+		for owner := range alloc.Owners {
+			owners = append(owners, owner)
+		}
+		sort.Strings(owners)
+		status.Allocations[ip] = owners
+	}
+	return status
+}
+
+// AddUsedIP marks ip as held by req, it is used to restore allocations
+// which are not recorded in the store yet.
+func (im *IPAMManager) AddUsedIP(ip string, req *Request) bool {
+	im.lock.RLock()
+	defer im.lock.RUnlock()
+
+	if p := im.getPoolOfIP(ip); p != nil {
+		p.lock.Lock()
+		defer p.lock.Unlock()
+
+		return im.hold(p, ip, req) == nil
 	}
 	return false
 }
 
-func (im *IPAMManager) AcquireSpecificIP(ip string) bool {
-	if cidr := im.getCidrOfIP(ip); cidr != "" {
-		if _, err := im.ipam.AcquireSpecificIP(cidr, ip); err == nil {
-			return true
+// AcquireSpecificIP acquires ip for req. Acquiring an ip already held by
+// the same owner succeeds, as does acquiring an ip shareable with req, which
+// is all a request with ShareOnly set may do.
+func (im *IPAMManager) AcquireSpecificIP(ip string, req *Request) bool {
+	im.lock.RLock()
+	defer im.lock.RUnlock()
+
+	if p := im.getPoolOfIP(ip); p != nil && p.Matches(req) && p.requestedBy(req) {
+		p.lock.Lock()
+		defer p.lock.Unlock()
+
+		// Excluded, reserved and quarantined addresses may only be kept by
+		// their existing holders, as may addresses outside of the delegations
+		// of the namespace of req.
+		parsed := net.ParseIP(ip)
+		if _, held := p.state.Allocations[ip]; !held && (req.ShareOnly || !p.usable(parsed) || im.reserved(parsed) || im.quarantined(p, ip, req.Owner)) {
+			return false
+		}
+		if !p.heldBy(ip, req.Owner) && !im.scope(req.Owner, p.family()).allows(p, parsed) {
+			return false
 		}
+		// Draining and skipped pools take no new holders.
+		if p.draining || containsString(req.SkipPools, p.Name) {
+			return p.heldBy(ip, req.Owner)
+		}
+		return im.hold(p, ip, req) == nil
 	}
 
 	return false
 }
 
-func (im *IPAMManager) AcquireIP() (string, error) {
-	for i := range im.cidrs {
-		if ip, err := im.ipam.AcquireIP(im.cidrs[i]); err == nil {
-			return ip.IP.String(), err
-		} else if err == goipam.ErrNoIPAvailable {
+// Refresh records the current sharing key and ports of req.Owner on ip. It
+// fails when ip can no longer be shared with its other holders, req.Owner
+// keeps holding ip then. Ips req.Owner does not hold are left alone.
+func (im *IPAMManager) Refresh(ip string, req *Request) error {
+	im.lock.RLock()
+	defer im.lock.RUnlock()
+
+	p := im.getPoolOfIP(ip)
+	if p == nil {
+		return nil
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if !p.heldBy(ip, req.Owner) {
+		return nil
+	}
+	return im.hold(p, ip, req)
+}
+
+// Held returns the ips of family req.Owner already holds in the pools it may
+// acquire from, e.g. once restored from a snapshot, sorted.
+func (im *IPAMManager) Held(req *Request, family corev1.IPFamily) []string {
+	im.lock.RLock()
+	defer im.lock.RUnlock()
+
+	var ips []string
+	for _, p := range im.candidates(req) {
+		if p.draining || p.family() != family || !p.Matches(req) {
 			continue
 		}
+		p.lock.Lock()
+		ips = append(ips, p.heldIPs(req.Owner)...)
+		p.lock.Unlock()
 	}
+	sort.Strings(ips)
+	return ips
+}
 
-	return "", errors.New("get ip failed")
+// AcquireIP acquires an ip of the given family for req from the first pool
+// req may use, never one req.Owner holds already. The ip retained for
+// req.Owner is handed back first, then a request with a sharing key joins an
+// ip shareable with it before a new ip is taken. Unless req asks for pools,
+// manual pools are skipped and new ips come from the pools of the highest
+// priority first, spread across them when Spread is set. A namespace with
+// delegations in family only gets ips of its delegated blocks. With
+// req.ShareOnly set only shareable ips are joined.
+func (im *IPAMManager) AcquireIP(req *Request, family corev1.IPFamily) (string, error) {
+	im.lock.RLock()
+	defer im.lock.RUnlock()
+
+	sc := im.scope(req.Owner, family)
+	pools := make([]*pool, 0, len(im.pools))
+	for _, p := range sc.restrict(im.candidates(req)) {
+		if p.Manual && len(req.Pools) == 0 {
+			continue
+		}
+		if !p.draining && p.family() == family && p.Matches(req) && !containsString(req.SkipPools, p.Name) {
+			pools = append(pools, p)
+		}
+	}
+
+	if !req.ShareOnly {
+		if ip := im.acquireRetained(pools, req, sc); ip != "" {
+			return ip, nil
+		}
+	}
+
+	if req.SharingKey != "" {
+		for _, p := range pools {
+			if ip := im.acquireShared(p, req, sc); ip != "" {
+				return ip, nil
+			}
+		}
+	}
+	if req.ShareOnly {
+		return "", fmt.Errorf("no shareable %s ip", family)
+	}
+
+	if im.Spread && len(req.Pools) == 0 {
+		spread(pools)
+	}
+
+	// Ips retained for other owners are only taken once nothing else is free.
+	for _, spareRetained := range []bool{true, false} {
+		for _, p := range pools {
+			ip, err := im.acquireFree(p, req, sc, spareRetained)
+			if err != nil || ip != "" {
+				return ip, err
+			}
+		}
+	}
+
+	return "", fmt.Errorf("get %s ip failed", family)
 }
 
-func (im *IPAMManager) ReleaseIP(ip string) error {
+// acquireRetained hands the ip of pools within sc most recently released by
+// req.Owner which is still retained and free back to it, or returns "".
+func (im *IPAMManager) acquireRetained(pools []*pool, req *Request, sc scope) string {
+	var found *pool
+	var latest time.Time
+	for _, p := range pools {
+		p.lock.Lock()
+		ip, at := im.retainedFor(p, req.Owner, sc)
+		p.lock.Unlock()
+		if ip != "" && (found == nil || at.After(latest)) {
+			found, latest = p, at
+		}
+	}
+	if found == nil {
+		return ""
+	}
 
-	if cidr := im.getCidrOfIP(ip); cidr != "" {
-		if err := im.ipam.ReleaseIPFromPrefix(cidr, ip); err == nil || err == goipam.ErrNotFound {
-			return nil
-		} else {
-			return err
+	found.lock.Lock()
+	defer found.lock.Unlock()
+
+	// The ip may have been taken since, look it up again.
+	if ip, _ := im.retainedFor(found, req.Owner, sc); ip != "" && im.hold(found, ip, req) == nil {
+		return ip
+	}
+	return ""
+}
+
+// acquireShared joins req to an ip of p shareable with it, or returns "".
+func (im *IPAMManager) acquireShared(p *pool, req *Request, sc scope) string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for ip, alloc := range p.state.Allocations {
+		if _, held := alloc.Owners[req.Owner]; held || !sc.allows(p, net.ParseIP(ip)) {
+			continue
+		}
+		if alloc.shareableWith(req) && im.hold(p, ip, req) == nil {
+			return ip
 		}
 	}
+	return ""
+}
 
+// acquireFree acquires the next free ip of p within sc for req, or returns
+// "" if p has none left.
+func (im *IPAMManager) acquireFree(p *pool, req *Request, sc scope, spareRetained bool) (string, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	ip := sc.view(p).nextFree(func(ip string) bool {
+		parsed := net.ParseIP(ip)
+		return im.quarantined(p, ip, req.Owner) || im.reserved(parsed) || !sc.allows(p, parsed) || spareRetained && im.retained(p, ip)
+	})
+	if ip == nil {
+		return "", nil
+	}
+	if err := im.hold(p, ip.String(), req); err != nil {
+		return "", err
+	}
+	return ip.String(), nil
+}
+
+// ReleaseIP drops owner from the holders of ip, the ip is given back once
+// nobody holds it anymore.
+func (im *IPAMManager) ReleaseIP(ip, owner string) error {
+	im.lock.RLock()
+	p := im.getPoolOfIP(ip)
+	if p == nil {
+		im.lock.RUnlock()
+		return nil
+	}
+	p.lock.Lock()
+	im.release(p, []string{ip}, owner)
+	drained := p.drained()
+	p.lock.Unlock()
+	im.lock.RUnlock()
+
+	if !drained {
+		return nil
+	}
+	return im.finishDrain(p.Name)
+}
+
+// ReleaseOwner drops owner from the holders of every ip it holds and
+// returns those ips.
+func (im *IPAMManager) ReleaseOwner(owner string) ([]string, error) {
+	var released, drained []string
+	im.lock.RLock()
+	for _, p := range im.pools {
+		p.lock.Lock()
+		ips := p.heldIPs(owner)
+		im.release(p, ips, owner)
+		if p.drained() {
+			drained = append(drained, p.Name)
+		}
+		p.lock.Unlock()
+		released = append(released, ips...)
+	}
+	im.lock.RUnlock()
+
+	for _, name := range drained {
+		if err := im.finishDrain(name); err != nil {
+			return released, err
+		}
+	}
+	return released, nil
+}
+
+// NamespaceUsage returns how many ips the services of namespace hold in
+// every pool. An ip shared by several services of namespace counts once.
+func (im *IPAMManager) NamespaceUsage(namespace string) map[string]int {
+	im.lock.RLock()
+	defer im.lock.RUnlock()
+
+	usage := make(map[string]int)
+	for _, p := range im.pools {
+		p.lock.Lock()
+		for _, alloc := range p.state.Allocations {
+			for owner := range alloc.Owners {
+				if strings.HasPrefix(owner, namespace+"/") {
+					usage[p.Name]++
+					break
+				}
+			}
+		}
+		p.lock.Unlock()
+	}
+	return usage
+}
+
+// Holders returns the owners of ip, sorted, or nil if nobody holds it.
+func (im *IPAMManager) Holders(ip string) []string {
+	im.lock.RLock()
+	defer im.lock.RUnlock()
+
+	p := im.getPoolOfIP(ip)
+	if p == nil {
+		return nil
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	alloc, ok := p.state.Allocations[ip]
+	if !ok {
+		return nil
+	}
+	owners := make([]string, 0, len(alloc.Owners))
+	for owner := range alloc.Owners {
+		owners = append(owners, owner)
+	}
+	sort.Strings(owners)
+	return owners
+}
+
+// Owners returns the ips held by every owner, sorted.
+func (im *IPAMManager) Owners() map[string][]string {
+	im.lock.RLock()
+	defer im.lock.RUnlock()
+
+	owners := make(map[string][]string)
+	for _, p := range im.pools {
+		p.lock.Lock()
+		for ip, alloc := range p.state.Allocations {
+			for owner := range alloc.Owners {
+				owners[owner] = append(owners[owner], ip)
+			}
+		}
+		p.lock.Unlock()
+	}
+	for _, ips := range owners {
+		sort.Strings(ips)
+	}
+	return owners
+}
+
+// PoolOf returns the name of the pool containing ip, or "" if there is none.
+func (im *IPAMManager) PoolOf(ip string) string {
+	im.lock.RLock()
+	defer im.lock.RUnlock()
+
+	if p := im.getPoolOfIP(ip); p != nil {
+		return p.Name
+	}
+	return ""
+}
+
+// FamilyOf returns the ip family of ip.
+func FamilyOf(ip net.IP) corev1.IPFamily {
+	if ip.To4() != nil {
+		return corev1.IPv4Protocol
+	}
+	return corev1.IPv6Protocol
+}
+
+func containsString(slice []string, s string) bool {
+	for _, item := range slice {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// insertPool adds p after the pools of the same or a higher priority.
+func (im *IPAMManager) insertPool(p *pool) {
+	i := sort.Search(len(im.pools), func(i int) bool {
+		return im.pools[i].Priority < p.Priority
+	})
+	im.pools = append(im.pools, nil)
+	copy(im.pools[i+1:], im.pools[i:])
+	im.pools[i] = p
+}
+
+// spread orders pools of the same priority by their allocations relative to
+// their weight, the least used first.
+func spread(pools []*pool) {
+	load := make(map[*pool]float64, len(pools))
+	for _, p := range pools {
+		p.lock.Lock()
+		load[p] = float64(len(p.state.Allocations)) / float64(p.weight())
+		p.lock.Unlock()
+	}
+	sort.SliceStable(pools, func(i, j int) bool {
+		if pools[i].Priority != pools[j].Priority {
+			return pools[i].Priority > pools[j].Priority
+		}
+		return load[pools[i]] < load[pools[j]]
+	})
+}
+
+func (im *IPAMManager) getPool(name string) *pool {
+	for _, p := range im.pools {
+		if p.Name == name {
+			return p
+		}
+	}
 	return nil
 }
 
-func (im *IPAMManager) getCidrOfIP(ip string) string {
+// candidates returns the pools tried for req, in order.
+func (im *IPAMManager) candidates(req *Request) []*pool {
+	if len(req.Pools) == 0 {
+		return im.pools
+	}
+	pools := make([]*pool, 0, len(req.Pools))
+	for _, name := range req.Pools {
+		if p := im.getPool(name); p != nil {
+			pools = append(pools, p)
+		}
+	}
+	return pools
+}
+
+func (im *IPAMManager) getPoolOfIP(ip string) *pool {
 	IP := net.ParseIP(ip)
-	for i := range im.cidrList {
-		if im.cidrList[i].Contains(IP) {
-			return im.cidrs[i]
+	if IP == nil {
+		return nil
+	}
+	return im.prefixes.lookup(IP)
+}
+
+// finishDrain removes the pool name once it is draining and has no
+// allocations left.
+func (im *IPAMManager) finishDrain(name string) error {
+	im.lock.Lock()
+	defer im.lock.Unlock()
+
+	if p := im.getPool(name); p == nil || !p.drained() {
+		return nil
+	}
+	return im.removePool(name)
+}
+
+func (im *IPAMManager) drainPolicy(p *pool) string {
+	if p.DrainPolicy != "" {
+		return p.DrainPolicy
+	}
+	if im.DrainPolicy != "" {
+		return im.DrainPolicy
+	}
+	return DrainKeep
+}
+
+// quarantined reports whether ip was released by another owner than owner
+// less than Quarantine ago.
+func (im *IPAMManager) quarantined(p *pool, ip, owner string) bool {
+	released, ok := p.state.Released[ip]
+	return ok && released.Owner != owner && im.Quarantine > 0 && im.now().Sub(released.At) < im.Quarantine
+}
+
+// retained reports whether ip was released less than Retention ago.
+func (im *IPAMManager) retained(p *pool, ip string) bool {
+	released, ok := p.state.Released[ip]
+	return ok && released.Owner != "" && im.Retention > 0 && im.now().Sub(released.At) < im.Retention
+}
+
+// retainedFor returns the ip of p within sc most recently released by owner
+// which is still retained and free, together with its release time.
+func (im *IPAMManager) retainedFor(p *pool, owner string, sc scope) (string, time.Time) {
+	var found string
+	var latest time.Time
+	for ip, released := range p.state.Released {
+		if released.Owner != owner || !im.retained(p, ip) || !p.usable(net.ParseIP(ip)) || !sc.allows(p, net.ParseIP(ip)) {
+			continue
+		}
+		if _, held := p.state.Allocations[ip]; held {
+			continue
+		}
+		if found == "" || released.At.After(latest) {
+			found, latest = ip, released.At
 		}
 	}
+	return found, latest
+}
 
-	return ""
+// release drops owner from the holders of ips and persists p if any of them
+// was held by owner.
+func (im *IPAMManager) release(p *pool, ips []string, owner string) {
+	changed := false
+	for _, ip := range ips {
+		if alloc, ok := p.state.Allocations[ip]; ok {
+			if _, held := alloc.Owners[owner]; held {
+				im.unhold(p, ip, owner)
+				changed = true
+			}
+		}
+	}
+	if changed {
+		im.persist(p)
+	}
+}
+
+// persist records the free addresses of p and marks its allocation state
+// to be written to the store by the next flush.
+func (im *IPAMManager) persist(p *pool) {
+	p.state.Free = p.free()
+	im.markDirty(p.Name)
+}
+
+func (im *IPAMManager) markDirty(name string) {
+	im.dirtyLock.Lock()
+	defer im.dirtyLock.Unlock()
+
+	if im.dirty == nil {
+		im.dirty = make(map[string]bool)
+	}
+	im.dirty[name] = true
+	if !im.flushing && im.batches == 0 {
+		im.flushing = true
+		go im.flushDirty()
+	}
+}
+
+func (im *IPAMManager) isDirty(name string) bool {
+	im.dirtyLock.Lock()
+	defer im.dirtyLock.Unlock()
+
+	return im.dirty[name]
+}
+
+// Flush writes the state of the pools changed since the last flush to the
+// store and deletes the state of the pools removed since. Changes are
+// flushed in the background anyway, Flush waits for them to be written,
+// e.g. before they are reported elsewhere. Pools failing to be written are
+// logged, counted by the bgplb_ipam_save_failures_total metric and retried by
+// the next flush.
+func (im *IPAMManager) Flush() error {
+	im.saving.Lock()
+	defer im.saving.Unlock()
+
+	im.dirtyLock.Lock()
+	dirty := im.dirty
+	im.dirty = nil
+	im.dirtyLock.Unlock()
+
+	var failed error
+	for name := range dirty {
+		if err := im.save(name); err != nil {
+			log.Error(err, "save pool error", "pool", name)
+			saveFailures.WithLabelValues(name).Inc()
+			im.markDirty(name)
+			failed = fmt.Errorf("save pool %s: %v", name, err)
+			continue
+		}
+		if im.OnChange != nil {
+			im.OnChange(name)
+		}
+	}
+	return failed
+}
+
+// Batch runs fn with the background flush held back and then flushes the
+// changes fn made at once, e.g. while allocations are restored in bulk,
+// which would have the whole state of a pool saved over and over again
+// otherwise.
+func (im *IPAMManager) Batch(fn func()) error {
+	im.dirtyLock.Lock()
+	im.batches++
+	im.dirtyLock.Unlock()
+
+	fn()
+
+	im.dirtyLock.Lock()
+	im.batches--
+	im.dirtyLock.Unlock()
+	return im.Flush()
+}
+
+// flushDirty flushes until no pool is left dirty, failed saves are retried
+// after flushRetry.
+func (im *IPAMManager) flushDirty() {
+	for {
+		err := im.Flush()
+
+		im.dirtyLock.Lock()
+		if len(im.dirty) == 0 || im.batches > 0 {
+			im.flushing = false
+			im.dirtyLock.Unlock()
+			return
+		}
+		im.dirtyLock.Unlock()
+
+		if err != nil {
+			time.Sleep(flushRetry)
+		}
+	}
+}
+
+// save writes a copy of the state of the pool name to the store, or deletes
+// its state if the pool is gone.
+func (im *IPAMManager) save(name string) error {
+	var state *PoolState
+	im.lock.RLock()
+	if p := im.getPool(name); p != nil {
+		p.lock.Lock()
+		state = p.state.deepCopy()
+		p.lock.Unlock()
+		state.FromCalico = p.FromCalico
+	}
+	im.lock.RUnlock()
+
+	if state == nil {
+		return im.store.Delete(name)
+	}
+	return im.store.Save(state)
+}
+
+// hold records req as a holder of ip, acquiring ip if nobody holds it yet.
+// An existing holder has its sharing key and ports refreshed.
+func (im *IPAMManager) hold(p *pool, ip string, req *Request) error {
+	alloc, ok := p.state.Allocations[ip]
+	if ok {
+		if _, held := alloc.Owners[req.Owner]; held {
+			return im.refresh(p, ip, alloc, req)
+		}
+		if !alloc.shareableWith(req) {
+			return fmt.Errorf("ip %s is already in use", ip)
+		}
+		alloc.Owners[req.Owner] = req.Ports
+	} else {
+		p.state.Allocations[ip] = newAllocation(req)
+		p.held.add(single(net.ParseIP(ip)))
+	}
+	delete(p.state.Released, ip)
+	im.persist(p)
+	return nil
+}
+
+// refresh records the sharing key and ports of req, which holds ip already,
+// unless ip can no longer be shared with its other holders.
+func (im *IPAMManager) refresh(p *pool, ip string, alloc *Allocation, req *Request) error {
+	ports := alloc.Owners[req.Owner]
+	if alloc.SharingKey == req.SharingKey && equalStrings(ports, req.Ports) {
+		return nil
+	}
+	if len(alloc.Owners) > 1 && !alloc.shareableWith(req) {
+		return fmt.Errorf("ip %s can no longer be shared with %d other services", ip, len(alloc.Owners)-1)
+	}
+	alloc.SharingKey = req.SharingKey
+	alloc.Owners[req.Owner] = req.Ports
+	im.persist(p)
+	return nil
+}
+
+// unhold drops owner from the holders of ip and frees ip once nobody holds
+// it, the releases nothing needs anymore are forgotten.
+func (im *IPAMManager) unhold(p *pool, ip, owner string) {
+	alloc, ok := p.state.Allocations[ip]
+	if !ok {
+		return
+	}
+	delete(alloc.Owners, owner)
+	if len(alloc.Owners) == 0 {
+		delete(p.state.Allocations, ip)
+		p.held.remove(net.ParseIP(ip))
+		p.state.Released[ip] = Release{Owner: owner, At: im.now()}
+		im.pruneReleased(p)
+	}
+}
+
+// pruneReleased forgets the releases of p which neither quarantine nor
+// retain their ip anymore, and which the strategy of p does not need.
+func (im *IPAMManager) pruneReleased(p *pool) {
+	keep := im.Quarantine
+	if im.Retention > keep {
+		keep = im.Retention
+	}
+	if p.Strategy == StrategyLeastRecentlyReleased && keep < releasedHistory {
+		keep = releasedHistory
+	}
+	now := im.now()
+	for ip, released := range p.state.Released {
+		if now.Sub(released.At) >= keep {
+			delete(p.state.Released, ip)
+		}
+	}
 }
@@ -0,0 +1,1993 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipam
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/LambdaHJ/bgplb/api/v1beta1"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// newStores returns one instance of every Store implementation.
+func newStores(t *testing.T) map[string]Store {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := v1beta1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	stores := make(map[string]Store)
+	for _, kind := range []string{StoreMemory, StoreCRD, StoreConfigMap} {
+		c := fake.NewFakeClientWithScheme(scheme)
+		store, err := NewStore(kind, c, c, "bgplb-system")
+		if err != nil {
+			t.Fatal(err)
+		}
+		stores[kind] = store
+	}
+	return stores
+}
+
+// flush waits for the changes of im to be written to its store.
+func flush(t *testing.T, im *IPAMManager) {
+	if err := im.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func owner(name string) *Request {
+	return &Request{Owner: name}
+}
+
+func TestAcquireAndRelease(t *testing.T) {
+	for kind, store := range newStores(t) {
+		t.Run(kind, func(t *testing.T) {
+			im := NewIPAMManager(store)
+			if err := im.NewCidr("10.0.0.0/30"); err != nil {
+				t.Fatal(err)
+			}
+
+			ip, err := im.AcquireIP(owner("default/a"), corev1.IPv4Protocol)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ip != "10.0.0.1" {
+				t.Errorf("expected 10.0.0.1, got %s", ip)
+			}
+			if !im.AcquireSpecificIP("10.0.0.2", owner("default/b")) {
+				t.Error("expected to acquire 10.0.0.2")
+			}
+			if im.AcquireSpecificIP("10.0.0.2", owner("default/c")) {
+				t.Error("10.0.0.2 is held by default/b")
+			}
+			if !im.AcquireSpecificIP("10.0.0.2", owner("default/b")) {
+				t.Error("acquiring an ip twice for the same owner should succeed")
+			}
+			if _, err := im.AcquireIP(owner("default/c"), corev1.IPv4Protocol); err == nil {
+				t.Error("expected 10.0.0.0/30 to be exhausted")
+			}
+
+			if err := im.ReleaseIP(ip, "default/a"); err != nil {
+				t.Fatal(err)
+			}
+			if !im.AcquireSpecificIP(ip, owner("default/c")) {
+				t.Errorf("expected %s to be released", ip)
+			}
+		})
+	}
+}
+
+func TestRestoreFromStore(t *testing.T) {
+	for kind, store := range newStores(t) {
+		t.Run(kind, func(t *testing.T) {
+			im := NewIPAMManager(store)
+			if err := im.NewCidr("10.0.0.0/24"); err != nil {
+				t.Fatal(err)
+			}
+			if !im.AcquireSpecificIP("10.0.0.10", owner("default/a")) {
+				t.Fatal("expected to acquire 10.0.0.10")
+			}
+
+			flush(t, im)
+			restarted := NewIPAMManager(store)
+			if err := restarted.NewCidr("10.0.0.0/24"); err != nil {
+				t.Fatal(err)
+			}
+			if restarted.AcquireSpecificIP("10.0.0.10", owner("default/b")) {
+				t.Error("10.0.0.10 should have been restored for default/a")
+			}
+			if !restarted.AcquireSpecificIP("10.0.0.10", owner("default/a")) {
+				t.Error("10.0.0.10 should still belong to default/a")
+			}
+
+			flush(t, restarted)
+			state, err := store.Load(PoolName("10.0.0.0/24"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := state.Allocations["10.0.0.10"].Owners["default/a"]; !ok || state.Free != 253 {
+				t.Errorf("unexpected persisted state %+v", state)
+			}
+		})
+	}
+}
+
+func TestCRDStore(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := v1beta1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	// A pool written by an earlier version, which only recorded the ips, and
+	// a pool of the same name outside of the namespace of the store.
+	legacy := &v1beta1.BGPIPsConfig{
+		ObjectMeta: metav1.ObjectMeta{Name: "public", Namespace: "bgplb-system"},
+		Spec: v1beta1.BGPIPsConfigSpec{
+			Cidr:    "10.0.0.0/24",
+			IPItems: &v1beta1.IPItemList{IPs: []string{"10.0.0.1", "10.0.0.2"}},
+		},
+	}
+	other := &v1beta1.BGPIPsConfig{
+		ObjectMeta: metav1.ObjectMeta{Name: "public", Namespace: "default"},
+		Spec: v1beta1.BGPIPsConfigSpec{
+			Cidr: "10.0.1.0/24",
+			IPItems: &v1beta1.IPItemList{Items: []v1beta1.IPItem{
+				{IP: "10.0.1.1", Owner: "default/other"},
+			}},
+		},
+	}
+	c := fake.NewFakeClientWithScheme(scheme, legacy, other)
+	store := NewCRDStore(c, c, "bgplb-system")
+
+	state, err := store.Load("public")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Cidr != "10.0.0.0/24" || len(state.Allocations) != 0 {
+		t.Errorf("expected the legacy pool without allocations, got %+v", state)
+	}
+
+	im := NewIPAMManager(store)
+	if err := im.AddPool(&Pool{Name: "public", Cidr: "10.0.0.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+	if !im.AcquireSpecificIP("10.0.0.1", &Request{Owner: "default/a", SharingKey: "default/web", Ports: []string{"TCP/80"}}) {
+		t.Fatal("expected to acquire 10.0.0.1")
+	}
+	flush(t, im)
+
+	saved := &v1beta1.BGPIPsConfig{}
+	if err := c.Get(context.Background(), types.NamespacedName{Namespace: "bgplb-system", Name: "public"}, saved); err != nil {
+		t.Fatal(err)
+	}
+	want := &v1beta1.IPItemList{Items: []v1beta1.IPItem{
+		{IP: "10.0.0.1", Owner: "default/a", SharingKey: "default/web", Ports: []string{"TCP/80"}},
+	}}
+	if !reflect.DeepEqual(saved.Spec.IPItems, want) || saved.Spec.Used != 1 {
+		t.Errorf("expected the ips to be replaced by %+v, got %+v", want, saved.Spec.IPItems)
+	}
+	if err := c.Get(context.Background(), types.NamespacedName{Namespace: "default", Name: "public"}, saved); err != nil {
+		t.Fatal(err)
+	}
+	if len(saved.Spec.IPItems.Items) != 1 || saved.Spec.IPItems.Items[0].Owner != "default/other" {
+		t.Errorf("expected the pool of another namespace to be left alone, got %+v", saved.Spec.IPItems)
+	}
+
+	state, err = store.Load("public")
+	if err != nil {
+		t.Fatal(err)
+	}
+	alloc := state.Allocations["10.0.0.1"]
+	if alloc == nil || alloc.SharingKey != "default/web" || !reflect.DeepEqual(alloc.Owners, map[string][]string{"default/a": {"TCP/80"}}) {
+		t.Errorf("unexpected allocation loaded back %+v", alloc)
+	}
+
+	// A pool without a BGPIPsConfig gets one in the namespace of the store.
+	if err := store.Save(&PoolState{Name: "calico", Cidr: "10.0.2.0/24", FromCalico: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Get(context.Background(), types.NamespacedName{Namespace: "bgplb-system", Name: "calico"}, saved); err != nil {
+		t.Errorf("expected the BGPIPsConfig to be created: %v", err)
+	}
+	if saved.Labels[CalicoPoolLabel] != "true" {
+		t.Errorf("expected the BGPIPsConfig of a Calico pool to be labeled, got %v", saved.Labels)
+	}
+
+	// Only the BGPIPsConfigs of Calico pools are deleted with their state.
+	for _, name := range []string{"calico", "public"} {
+		if err := store.Delete(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Get(context.Background(), types.NamespacedName{Namespace: "bgplb-system", Name: "calico"}, saved); !errors.IsNotFound(err) {
+		t.Errorf("expected the BGPIPsConfig of the Calico pool to be deleted, got %v", err)
+	}
+	if err := c.Get(context.Background(), types.NamespacedName{Namespace: "bgplb-system", Name: "public"}, saved); err != nil {
+		t.Errorf("expected the BGPIPsConfig of a named pool to be kept: %v", err)
+	}
+}
+
+func TestRestoreCalicoPool(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := v1beta1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	c := fake.NewFakeClientWithScheme(scheme)
+	store := NewCRDStore(c, c, "bgplb-system")
+	im := NewIPAMManager(store)
+	if err := im.NewCidr("10.0.0.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	if !im.AcquireSpecificIP("10.0.0.10", owner("default/a")) {
+		t.Fatal("expected to acquire 10.0.0.10")
+	}
+
+	flush(t, im)
+	// On restart the BGPIPsConfig the store created for the cidr is told
+	// apart by its label and added as a Calico pool.
+	restarted := NewIPAMManager(store)
+	list := &v1beta1.BGPIPsConfigList{}
+	if err := c.List(context.Background(), list); err != nil {
+		t.Fatal(err)
+	}
+	for i := range list.Items {
+		if !IsCalicoConfig(&list.Items[i]) {
+			t.Fatalf("expected %s to be labeled as a Calico config", list.Items[i].Name)
+		}
+		p := &Pool{Name: list.Items[i].Name, Cidr: list.Items[i].Spec.Cidr, FromCalico: true}
+		if err := restarted.AddPool(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := restarted.NewCidr("10.0.0.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	if pools := restarted.CalicoPools(); len(pools) != 1 || pools[0].Name != PoolName("10.0.0.0/24") {
+		t.Fatalf("expected the pool to stay a Calico pool, got %+v", pools)
+	}
+	if restarted.AcquireSpecificIP("10.0.0.10", owner("default/b")) {
+		t.Error("10.0.0.10 should have been restored for default/a")
+	}
+
+	// A pool of its own for the same cidr is not taken over.
+	other := NewIPAMManager(NewMemoryStore())
+	if err := other.AddPool(&Pool{Name: "public", Cidr: "10.0.0.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.NewCidr("10.0.0.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	if pools := other.CalicoPools(); len(pools) != 0 {
+		t.Errorf("expected no Calico pool, got %+v", pools)
+	}
+}
+
+func TestReadOnlyStore(t *testing.T) {
+	store := NewMemoryStore()
+	im := NewIPAMManager(store)
+	if err := im.NewCidr("10.0.0.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	if !im.AcquireSpecificIP("10.0.0.10", owner("default/a")) {
+		t.Fatal("expected to acquire 10.0.0.10")
+	}
+
+	flush(t, im)
+	readOnly := NewIPAMManager(ReadOnlyStore{Store: store})
+	if err := readOnly.NewCidr("10.0.0.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	if holders := readOnly.Holders("10.0.0.10"); len(holders) != 1 || holders[0] != "default/a" {
+		t.Errorf("expected 10.0.0.10 to be loaded for default/a, got %v", holders)
+	}
+	if err := readOnly.ReleaseIP("10.0.0.10", "default/a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := readOnly.RemovePool(PoolName("10.0.0.0/24")); err != nil {
+		t.Fatal(err)
+	}
+	flush(t, readOnly)
+	state, err := store.Load(PoolName("10.0.0.0/24"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := state.Allocations["10.0.0.10"]; !ok {
+		t.Errorf("expected the store to be left alone, got %+v", state)
+	}
+}
+
+func TestAcquireByFamily(t *testing.T) {
+	im := NewIPAMManager(NewMemoryStore())
+	for _, cidr := range []string{"10.0.0.0/30", "fd00::/126"} {
+		if err := im.NewCidr(cidr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ip, err := im.AcquireIP(owner("default/a"), corev1.IPv6Protocol)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip != "fd00::1" {
+		t.Errorf("expected fd00::1, got %s", ip)
+	}
+	ip, err = im.AcquireIP(owner("default/a"), corev1.IPv4Protocol)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip != "10.0.0.1" {
+		t.Errorf("expected 10.0.0.1, got %s", ip)
+	}
+	if !im.AcquireSpecificIP("fd00::2", owner("default/b")) {
+		t.Error("expected to acquire fd00::2")
+	}
+	if err := im.ReleaseIP("fd00::2", "default/b"); err != nil {
+		t.Fatal(err)
+	}
+	if !im.AcquireSpecificIP("fd00::2", owner("default/c")) {
+		t.Error("expected fd00::2 to be released")
+	}
+}
+
+func TestPoolSelectors(t *testing.T) {
+	im := NewIPAMManager(NewMemoryStore())
+	public := &Pool{
+		Name:              "public",
+		Cidr:              "10.0.0.0/30",
+		NamespaceSelector: labels.SelectorFromSet(labels.Set{"name": "ingress"}),
+	}
+	internal := &Pool{
+		Name:            "internal",
+		Cidr:            "10.0.1.0/30",
+		ServiceSelector: labels.SelectorFromSet(labels.Set{"tier": "internal"}),
+	}
+	for _, p := range []*Pool{public, internal} {
+		if err := im.AddPool(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ingress := &Request{Owner: "ingress/a", NamespaceLabels: labels.Set{"name": "ingress"}}
+	ip, err := im.AcquireIP(ingress, corev1.IPv4Protocol)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip != "10.0.0.1" {
+		t.Errorf("expected 10.0.0.1 from public, got %s", ip)
+	}
+
+	other := &Request{Owner: "default/a", Labels: labels.Set{"tier": "internal"}}
+	ip, err = im.AcquireIP(other, corev1.IPv4Protocol)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip != "10.0.1.1" {
+		t.Errorf("expected 10.0.1.1 from internal, got %s", ip)
+	}
+	if im.AcquireSpecificIP("10.0.0.2", other) {
+		t.Error("default/a may not use the public pool")
+	}
+	if _, err := im.AcquireIP(owner("default/b"), corev1.IPv4Protocol); err == nil {
+		t.Error("default/b matches no pool")
+	}
+
+	if err := im.RemovePool("internal"); err != ErrPoolInUse {
+		t.Errorf("expected ErrPoolInUse, got %v", err)
+	}
+}
+
+func TestRequestedPools(t *testing.T) {
+	im := NewIPAMManager(NewMemoryStore())
+	for _, cidr := range []string{"10.0.0.0/30", "10.0.1.0/30"} {
+		if err := im.NewCidr(cidr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req := &Request{Owner: "default/a", Pools: []string{PoolName("10.0.1.0/30")}}
+	ip, err := im.AcquireIP(req, corev1.IPv4Protocol)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip != "10.0.1.1" {
+		t.Errorf("expected 10.0.1.1, got %s", ip)
+	}
+	if im.PoolOf(ip) != PoolName("10.0.1.0/30") {
+		t.Errorf("unexpected pool %s of %s", im.PoolOf(ip), ip)
+	}
+	if im.AcquireSpecificIP("10.0.0.1", req) {
+		t.Error("10.0.0.1 is not in the requested pool")
+	}
+}
+
+func TestSharedIP(t *testing.T) {
+	for kind, store := range newStores(t) {
+		t.Run(kind, func(t *testing.T) {
+			im := NewIPAMManager(store)
+			if err := im.NewCidr("10.0.0.0/30"); err != nil {
+				t.Fatal(err)
+			}
+
+			tcp := &Request{Owner: "default/tcp", SharingKey: "default/dns", Ports: []string{"TCP/53"}}
+			udp := &Request{Owner: "default/udp", SharingKey: "default/dns", Ports: []string{"UDP/53"}}
+			dup := &Request{Owner: "default/dup", SharingKey: "default/dns", Ports: []string{"UDP/53"}}
+			other := &Request{Owner: "default/other", SharingKey: "default/web", Ports: []string{"TCP/80"}}
+
+			ip, err := im.AcquireIP(tcp, corev1.IPv4Protocol)
+			if err != nil {
+				t.Fatal(err)
+			}
+			shared, err := im.AcquireIP(udp, corev1.IPv4Protocol)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if shared != ip {
+				t.Errorf("expected default/udp to share %s, got %s", ip, shared)
+			}
+			if im.AcquireSpecificIP(ip, dup) {
+				t.Error("UDP/53 is already used on the shared ip")
+			}
+			if im.AcquireSpecificIP(ip, other) {
+				t.Error("a different sharing key may not use the shared ip")
+			}
+
+			flush(t, im)
+			restarted := NewIPAMManager(store)
+			if err := restarted.NewCidr("10.0.0.0/30"); err != nil {
+				t.Fatal(err)
+			}
+			if err := restarted.ReleaseIP(ip, "default/tcp"); err != nil {
+				t.Fatal(err)
+			}
+			if restarted.AcquireSpecificIP(ip, other) {
+				t.Errorf("%s is still held by default/udp", ip)
+			}
+			if err := restarted.ReleaseIP(ip, "default/udp"); err != nil {
+				t.Fatal(err)
+			}
+			if !restarted.AcquireSpecificIP(ip, other) {
+				t.Errorf("expected %s to be released", ip)
+			}
+		})
+	}
+}
+
+func TestRefreshSharedIP(t *testing.T) {
+	for kind, store := range newStores(t) {
+		t.Run(kind, func(t *testing.T) {
+			im := NewIPAMManager(store)
+			if err := im.NewCidr("10.0.0.0/30"); err != nil {
+				t.Fatal(err)
+			}
+			tcp := &Request{Owner: "default/tcp", SharingKey: "default/dns", Ports: []string{"TCP/53"}}
+			udp := &Request{Owner: "default/udp", SharingKey: "default/dns", Ports: []string{"UDP/53"}}
+			ip, err := im.AcquireIP(tcp, corev1.IPv4Protocol)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !im.AcquireSpecificIP(ip, udp) {
+				t.Fatalf("expected default/udp to share %s", ip)
+			}
+
+			// New ports are recorded, and checked against the other holders.
+			udp.Ports = []string{"UDP/53", "UDP/5353"}
+			if err := im.Refresh(ip, udp); err != nil {
+				t.Fatal(err)
+			}
+			clash := &Request{Owner: "default/clash", SharingKey: "default/dns", Ports: []string{"UDP/5353"}}
+			if im.AcquireSpecificIP(ip, clash) {
+				t.Error("UDP/5353 is now used on the shared ip")
+			}
+			udp.Ports = []string{"TCP/53"}
+			if err := im.Refresh(ip, udp); err == nil {
+				t.Error("expected TCP/53 to clash with default/tcp")
+			}
+			if im.AcquireSpecificIP(ip, udp) {
+				t.Error("expected acquiring again to fail the same way")
+			}
+			tcp.SharingKey = "default/other"
+			if err := im.Refresh(ip, tcp); err == nil {
+				t.Error("expected another sharing key to be refused")
+			}
+
+			flush(t, im)
+			// The failed refreshes left the holders as they were.
+			state, err := store.Load(PoolName("10.0.0.0/30"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			alloc := state.Allocations[ip]
+			if alloc == nil || alloc.SharingKey != "default/dns" || !equalStrings(alloc.Owners["default/udp"], []string{"UDP/53", "UDP/5353"}) ||
+				!equalStrings(alloc.Owners["default/tcp"], []string{"TCP/53"}) {
+				t.Errorf("unexpected allocation %+v", alloc)
+			}
+			if err := im.Refresh(ip, owner("default/nobody")); err != nil {
+				t.Errorf("expected an ip not held to be left alone, got %v", err)
+			}
+		})
+	}
+}
+
+func TestExcludes(t *testing.T) {
+	store := NewMemoryStore()
+	im := NewIPAMManager(store)
+	excluded := &Pool{
+		Name:     "excluded",
+		Cidr:     "10.0.0.0/29",
+		Excludes: []string{"10.0.0.1", "10.0.0.3-10.0.0.4", "10.0.0.4/32"},
+	}
+	whole := &Pool{Name: "whole", Cidr: "10.0.1.0/31", AllowNetworkBroadcast: true}
+	single := &Pool{Name: "single", Cidr: "10.0.2.1/32"}
+	for _, p := range []*Pool{excluded, whole, single} {
+		if err := im.AddPool(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	flush(t, im)
+	state, _ := store.Load("excluded")
+	if state.Free != 3 {
+		t.Errorf("expected 3 free ips, got %d", state.Free)
+	}
+	for _, ip := range []string{"10.0.0.0", "10.0.0.1", "10.0.0.3", "10.0.0.4", "10.0.0.7"} {
+		if im.AcquireSpecificIP(ip, &Request{Owner: "default/a", Pools: []string{"excluded"}}) {
+			t.Errorf("%s should not be handed out", ip)
+		}
+	}
+	req := &Request{Owner: "default/a", Pools: []string{"excluded"}}
+	for _, expected := range []string{"10.0.0.2", "10.0.0.5", "10.0.0.6"} {
+		ip, err := im.AcquireIP(req, corev1.IPv4Protocol)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ip != expected {
+			t.Errorf("expected %s, got %s", expected, ip)
+		}
+	}
+	if _, err := im.AcquireIP(req, corev1.IPv4Protocol); err == nil {
+		t.Error("expected the excluded pool to be exhausted")
+	}
+
+	for _, ip := range []string{"10.0.1.0", "10.0.1.1", "10.0.2.1"} {
+		if !im.AcquireSpecificIP(ip, owner("default/b")) {
+			t.Errorf("expected to acquire %s", ip)
+		}
+	}
+}
+
+func TestRangePools(t *testing.T) {
+	r, err := parseRange("10.20.0.17-10.20.0.42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var prefixes []string
+	for _, prefix := range r.cidrs() {
+		prefixes = append(prefixes, prefix.String())
+	}
+	expected := []string{"10.20.0.17/32", "10.20.0.18/31", "10.20.0.20/30", "10.20.0.24/29", "10.20.0.32/29", "10.20.0.40/31", "10.20.0.42/32"}
+	if !equalStrings(prefixes, expected) {
+		t.Errorf("expected %v, got %v", expected, prefixes)
+	}
+
+	for name, store := range newStores(t) {
+		im := NewIPAMManager(store)
+		p := &Pool{Name: "range", Ranges: []string{"10.20.0.17-10.20.0.20", "10.20.1.0-10.20.1.1"}}
+		if err := im.AddPool(p); err != nil {
+			t.Fatal(name, err)
+		}
+		for _, expected := range []string{"10.20.0.17", "10.20.0.18", "10.20.0.19", "10.20.0.20", "10.20.1.0", "10.20.1.1"} {
+			ip, err := im.AcquireIP(owner("default/a"), corev1.IPv4Protocol)
+			if err != nil {
+				t.Fatal(name, err)
+			}
+			if ip != expected {
+				t.Errorf("%s: expected %s, got %s", name, expected, ip)
+			}
+		}
+		if _, err := im.AcquireIP(owner("default/a"), corev1.IPv4Protocol); err == nil {
+			t.Errorf("%s: expected the range pool to be exhausted", name)
+		}
+		if pool := im.PoolOf("10.20.0.21"); pool != "" {
+			t.Errorf("%s: 10.20.0.21 is outside of the ranges, got pool %q", name, pool)
+		}
+		if err := im.ReleaseIP("10.20.0.19", "default/a"); err != nil {
+			t.Fatal(name, err)
+		}
+
+		flush(t, im)
+		restarted := NewIPAMManager(store)
+		if err := restarted.AddPool(p); err != nil {
+			t.Fatal(name, err)
+		}
+		if ip, err := restarted.AcquireIP(owner("default/b"), corev1.IPv4Protocol); err != nil || ip != "10.20.0.19" {
+			t.Errorf("%s: expected 10.20.0.19 after restart, got %s %v", name, ip, err)
+		}
+	}
+
+	im := NewIPAMManager(NewMemoryStore())
+	for _, p := range []*Pool{
+		{Name: "overlap", Cidr: "10.30.0.0/28", Ranges: []string{"10.30.0.10-10.30.0.20"}},
+		{Name: "families", Ranges: []string{"10.30.1.1-10.30.1.2", "fd00::1-fd00::2"}},
+		{Name: "empty"},
+	} {
+		if err := im.AddPool(p); err == nil {
+			t.Errorf("expected pool %s to be rejected", p.Name)
+		}
+	}
+}
+
+func TestSequentialStrategy(t *testing.T) {
+	im := NewIPAMManager(NewMemoryStore())
+	if err := im.AddPool(&Pool{Name: "seq", Cidr: "10.0.0.0/29", Strategy: StrategySequential}); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		if ip, _ := im.AcquireIP(owner("default/a"), corev1.IPv4Protocol); ip != expected {
+			t.Errorf("expected %s, got %s", expected, ip)
+		}
+	}
+	if err := im.ReleaseIP("10.0.0.2", "default/a"); err != nil {
+		t.Fatal(err)
+	}
+	if ip, _ := im.AcquireIP(owner("default/b"), corev1.IPv4Protocol); ip != "10.0.0.2" {
+		t.Errorf("expected the released 10.0.0.2 to be reused, got %s", ip)
+	}
+}
+
+func TestRandomStrategy(t *testing.T) {
+	im := NewIPAMManager(NewMemoryStore())
+	im.rand = rand.New(rand.NewSource(1))
+	p := &Pool{
+		Name:     "random",
+		Cidr:     "10.0.0.0/28",
+		Ranges:   []string{"10.0.1.5-10.0.1.9"},
+		Excludes: []string{"10.0.0.3"},
+		Strategy: StrategyRandom,
+	}
+	if err := im.AddPool(p); err != nil {
+		t.Fatal(err)
+	}
+
+	// 13 usable addresses in the cidr and 5 in the range.
+	seen := make(map[string]bool)
+	var order []string
+	for i := 0; i < 18; i++ {
+		ip, err := im.AcquireIP(owner("default/a"), corev1.IPv4Protocol)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[ip] {
+			t.Fatalf("%s handed out twice", ip)
+		}
+		if ip == "10.0.0.0" || ip == "10.0.0.3" || ip == "10.0.0.15" || im.PoolOf(ip) != "random" {
+			t.Errorf("%s should not be handed out", ip)
+		}
+		seen[ip] = true
+		order = append(order, ip)
+	}
+	if _, err := im.AcquireIP(owner("default/a"), corev1.IPv4Protocol); err == nil {
+		t.Error("expected the random pool to be exhausted")
+	}
+	sequential := true
+	for i := 1; i < len(order); i++ {
+		if ipToInt(net.ParseIP(order[i])).Cmp(ipToInt(net.ParseIP(order[i-1]))) < 0 {
+			sequential = false
+		}
+	}
+	if sequential {
+		t.Errorf("expected a random order, got %v", order)
+	}
+}
+
+func TestLeastRecentlyReleasedStrategy(t *testing.T) {
+	for name, store := range newStores(t) {
+		clock := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+		im := NewIPAMManager(store)
+		im.now = func() time.Time { return clock }
+		p := &Pool{Name: "lrr", Cidr: "10.0.0.0/29", Strategy: StrategyLeastRecentlyReleased}
+		if err := im.AddPool(p); err != nil {
+			t.Fatal(name, err)
+		}
+		for i := 0; i < 6; i++ {
+			if _, err := im.AcquireIP(owner("default/a"), corev1.IPv4Protocol); err != nil {
+				t.Fatal(name, err)
+			}
+		}
+		for _, ip := range []string{"10.0.0.4", "10.0.0.2", "10.0.0.5"} {
+			clock = clock.Add(time.Minute)
+			if err := im.ReleaseIP(ip, "default/a"); err != nil {
+				t.Fatal(name, err)
+			}
+		}
+
+		flush(t, im)
+		// The release times survive a restart.
+		restarted := NewIPAMManager(store)
+		if err := restarted.AddPool(p); err != nil {
+			t.Fatal(name, err)
+		}
+		for _, expected := range []string{"10.0.0.4", "10.0.0.2", "10.0.0.5"} {
+			ip, err := restarted.AcquireIP(owner("default/b"), corev1.IPv4Protocol)
+			if err != nil {
+				t.Fatal(name, err)
+			}
+			if ip != expected {
+				t.Errorf("%s: expected %s, got %s", name, expected, ip)
+			}
+		}
+	}
+
+	// Addresses never used before come first.
+	fresh := NewIPAMManager(NewMemoryStore())
+	if err := fresh.AddPool(&Pool{Name: "fresh", Cidr: "10.0.1.0/29", Strategy: StrategyLeastRecentlyReleased}); err != nil {
+		t.Fatal(err)
+	}
+	ip, _ := fresh.AcquireIP(owner("default/a"), corev1.IPv4Protocol)
+	if err := fresh.ReleaseIP(ip, "default/a"); err != nil {
+		t.Fatal(err)
+	}
+	if next, _ := fresh.AcquireIP(owner("default/b"), corev1.IPv4Protocol); next == ip {
+		t.Errorf("expected an unused ip rather than the released %s", ip)
+	}
+}
+
+func TestPruneReleased(t *testing.T) {
+	clock := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	im := NewIPAMManager(NewMemoryStore())
+	im.Quarantine = time.Minute
+	im.Retention = time.Hour
+	im.now = func() time.Time { return clock }
+	for _, p := range []*Pool{
+		{Name: "sequential", Cidr: "10.0.0.0/29"},
+		{Name: "lrr", Cidr: "10.0.1.0/29", Strategy: StrategyLeastRecentlyReleased},
+	} {
+		if err := im.AddPool(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cycle := func(ips ...string) {
+		for _, ip := range ips {
+			if !im.AcquireSpecificIP(ip, owner("default/a")) {
+				t.Fatalf("expected to acquire %s", ip)
+			}
+			if err := im.ReleaseIP(ip, "default/a"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	released := func(pool string) []string {
+		var ips []string
+		for ip := range im.getPool(pool).state.Released {
+			ips = append(ips, ip)
+		}
+		sort.Strings(ips)
+		return ips
+	}
+
+	cycle("10.0.0.2", "10.0.1.2")
+	clock = clock.Add(30 * time.Minute)
+	cycle("10.0.0.3", "10.0.1.3")
+	if ips := released("sequential"); !equalStrings(ips, []string{"10.0.0.2", "10.0.0.3"}) {
+		t.Errorf("expected the retained releases to be kept, got %v", ips)
+	}
+
+	// Past the retention only the least recently released strategy needs
+	// the releases.
+	clock = clock.Add(time.Hour)
+	cycle("10.0.0.4", "10.0.1.4")
+	if ips := released("sequential"); !equalStrings(ips, []string{"10.0.0.4"}) {
+		t.Errorf("expected the releases past the retention to be forgotten, got %v", ips)
+	}
+	if ips := released("lrr"); !equalStrings(ips, []string{"10.0.1.2", "10.0.1.3", "10.0.1.4"}) {
+		t.Errorf("expected the least recently released pool to keep its releases, got %v", ips)
+	}
+
+	clock = clock.Add(releasedHistory)
+	cycle("10.0.1.5")
+	if ips := released("lrr"); !equalStrings(ips, []string{"10.0.1.5"}) {
+		t.Errorf("expected the releases past the history to be forgotten, got %v", ips)
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	for name, store := range newStores(t) {
+		clock := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+		now := func() time.Time { return clock }
+		im := NewIPAMManager(store)
+		im.Quarantine = time.Hour
+		im.now = now
+		p := &Pool{Name: "quarantine", Cidr: "10.0.0.0/30"}
+		if err := im.AddPool(p); err != nil {
+			t.Fatal(name, err)
+		}
+		ip, err := im.AcquireIP(owner("default/a"), corev1.IPv4Protocol)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if err := im.ReleaseIP(ip, "default/a"); err != nil {
+			t.Fatal(name, err)
+		}
+
+		flush(t, im)
+		// The quarantine survives a restart.
+		restarted := NewIPAMManager(store)
+		restarted.Quarantine = time.Hour
+		restarted.now = now
+		if err := restarted.AddPool(p); err != nil {
+			t.Fatal(name, err)
+		}
+		if restarted.AcquireSpecificIP(ip, owner("default/b")) {
+			t.Errorf("%s: quarantined %s should not be handed out", name, ip)
+		}
+		next, err := restarted.AcquireIP(owner("default/b"), corev1.IPv4Protocol)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if next == ip {
+			t.Errorf("%s: quarantined %s should not be handed out", name, ip)
+		}
+		if _, err := restarted.AcquireIP(owner("default/c"), corev1.IPv4Protocol); err == nil {
+			t.Errorf("%s: expected no ip while %s is quarantined", name, ip)
+		}
+
+		clock = clock.Add(time.Hour)
+		if again, err := restarted.AcquireIP(owner("default/c"), corev1.IPv4Protocol); err != nil || again != ip {
+			t.Errorf("%s: expected %s once the quarantine is over, got %s %v", name, ip, again, err)
+		}
+	}
+}
+
+func TestStickyIP(t *testing.T) {
+	for name, store := range newStores(t) {
+		clock := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+		now := func() time.Time { return clock }
+		im := NewIPAMManager(store)
+		im.Quarantine = time.Minute
+		im.Retention = time.Hour
+		im.now = now
+		p := &Pool{Name: "sticky", Cidr: "10.0.0.0/29"}
+		if err := im.AddPool(p); err != nil {
+			t.Fatal(name, err)
+		}
+		for _, svc := range []string{"default/a", "default/b", "default/c"} {
+			if _, err := im.AcquireIP(owner(svc), corev1.IPv4Protocol); err != nil {
+				t.Fatal(name, err)
+			}
+		}
+		released, err := im.ReleaseOwner("default/b")
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if len(released) != 1 || released[0] != "10.0.0.2" {
+			t.Fatalf("%s: expected 10.0.0.2 to be released, got %v", name, released)
+		}
+
+		flush(t, im)
+		restarted := NewIPAMManager(store)
+		restarted.Quarantine = time.Minute
+		restarted.Retention = time.Hour
+		restarted.now = now
+		if err := restarted.AddPool(p); err != nil {
+			t.Fatal(name, err)
+		}
+		clock = clock.Add(10 * time.Minute)
+		// Other services skip the retained ip while others are free.
+		if ip, _ := restarted.AcquireIP(owner("default/d"), corev1.IPv4Protocol); ip != "10.0.0.4" {
+			t.Errorf("%s: expected 10.0.0.4, got %s", name, ip)
+		}
+		// The recreated service gets its ip back, even within the quarantine.
+		if ip, _ := restarted.AcquireIP(owner("default/b"), corev1.IPv4Protocol); ip != "10.0.0.2" {
+			t.Errorf("%s: expected 10.0.0.2 back, got %s", name, ip)
+		}
+		if _, err := restarted.ReleaseOwner("default/b"); err != nil {
+			t.Fatal(name, err)
+		}
+
+		clock = clock.Add(time.Hour)
+		if ip, _ := restarted.AcquireIP(owner("default/e"), corev1.IPv4Protocol); ip != "10.0.0.2" {
+			t.Errorf("%s: expected 10.0.0.2 once the retention is over, got %s", name, ip)
+		}
+	}
+
+	// Retained ips are handed to other services once nothing else is free.
+	im := NewIPAMManager(NewMemoryStore())
+	im.Retention = time.Hour
+	if err := im.AddPool(&Pool{Name: "full", Cidr: "10.0.1.0/30"}); err != nil {
+		t.Fatal(err)
+	}
+	ip, _ := im.AcquireIP(owner("default/a"), corev1.IPv4Protocol)
+	if _, err := im.ReleaseOwner("default/a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := im.AcquireIP(owner("default/b"), corev1.IPv4Protocol); err != nil {
+		t.Fatal(err)
+	}
+	if next, err := im.AcquireIP(owner("default/c"), corev1.IPv4Protocol); err != nil || next != ip {
+		t.Errorf("expected the retained %s, got %s %v", ip, next, err)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	im := NewIPAMManager(NewMemoryStore())
+	var lock sync.Mutex
+	var changes []string
+	im.OnChange = func(pool string) {
+		lock.Lock()
+		defer lock.Unlock()
+		changes = append(changes, pool)
+	}
+	p := &Pool{Name: "status", Cidr: "10.0.0.0/29", Ranges: []string{"10.0.1.1-10.0.1.2"}, Excludes: []string{"10.0.0.6"}}
+	if err := im.AddPool(p); err != nil {
+		t.Fatal(err)
+	}
+	if im.Status("missing") != nil {
+		t.Error("expected no status for a missing pool")
+	}
+	shared := &Request{Owner: "default/a", SharingKey: "default/key", Ports: []string{"TCP/80"}}
+	ip, err := im.AcquireIP(shared, corev1.IPv4Protocol)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := &Request{Owner: "default/b", SharingKey: "default/key", Ports: []string{"TCP/443"}}
+	if !im.AcquireSpecificIP(ip, other) {
+		t.Fatalf("expected to share %s", ip)
+	}
+	if !im.AcquireSpecificIP("10.0.1.2", owner("default/c")) {
+		t.Fatal("expected to acquire 10.0.1.2")
+	}
+
+	status := im.Status("status")
+	if status.Total != 7 || status.Used != 2 || status.Free != 5 {
+		t.Errorf("expected 7 total, 2 used and 5 free, got %+v", status)
+	}
+	if owners := status.Allocations[ip]; len(owners) != 2 || owners[0] != "default/a" || owners[1] != "default/b" {
+		t.Errorf("expected %s to be held by default/a and default/b, got %v", ip, owners)
+	}
+	// Changes are reported once they are saved, possibly several at once.
+	flush(t, im)
+	lock.Lock()
+	defer lock.Unlock()
+	if len(changes) == 0 || changes[len(changes)-1] != "status" {
+		t.Errorf("expected the changes of status to be reported, got %v", changes)
+	}
+}
+
+func TestDrainPool(t *testing.T) {
+	im := NewIPAMManager(NewMemoryStore())
+	for _, p := range []*Pool{
+		{Name: "old", Cidr: "10.0.0.0/29", DrainPolicy: DrainMigrate},
+		{Name: "new", Cidr: "10.0.1.0/29"},
+	} {
+		if err := im.AddPool(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	shared := &Request{Owner: "default/a", SharingKey: "default/key", Ports: []string{"TCP/80"}, Pools: []string{"old"}}
+	ip, err := im.AcquireIP(shared, corev1.IPv4Protocol)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := im.RemovePool("old"); err != ErrPoolInUse {
+		t.Fatalf("expected ErrPoolInUse, got %v", err)
+	}
+	if status := im.Status("old"); status == nil || !status.Draining {
+		t.Fatalf("expected old to be draining, got %+v", status)
+	}
+	if !im.Migrating(ip) {
+		t.Errorf("expected %s to be migrated", ip)
+	}
+	other := &Request{Owner: "default/b", SharingKey: "default/key", Ports: []string{"TCP/443"}}
+	if im.AcquireSpecificIP(ip, other) {
+		t.Errorf("draining pool should take no new holders of %s", ip)
+	}
+	if !im.AcquireSpecificIP(ip, shared) {
+		t.Errorf("expected default/a to keep %s", ip)
+	}
+	if next, _ := im.AcquireIP(other, corev1.IPv4Protocol); im.PoolOf(next) != "new" {
+		t.Errorf("expected an ip of the new pool, got %s", next)
+	}
+
+	if err := im.ReleaseIP(ip, "default/a"); err != nil {
+		t.Fatal(err)
+	}
+	if im.HasPool("old") {
+		t.Error("expected the drained pool to be removed")
+	}
+
+	// A Calico cidr coming back puts its draining pool back in use.
+	if err := im.NewCidr("10.0.2.0/29"); err != nil {
+		t.Fatal(err)
+	}
+	calico := PoolName("10.0.2.0/29")
+	if _, err := im.AcquireIP(&Request{Owner: "default/c", Pools: []string{calico}}, corev1.IPv4Protocol); err != nil {
+		t.Fatal(err)
+	}
+	if err := im.RemovePool(calico); err != ErrPoolInUse {
+		t.Fatalf("expected ErrPoolInUse, got %v", err)
+	}
+	if err := im.NewCidr("10.0.2.0/29"); err != nil {
+		t.Fatal(err)
+	}
+	if im.Status(calico).Draining {
+		t.Error("expected the Calico pool to be back in use")
+	}
+}
+
+func TestConflicts(t *testing.T) {
+	im := NewIPAMManager(NewMemoryStore())
+	if err := im.AddPool(&Pool{Name: "public", Cidr: "10.0.0.0/29"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := im.AddPool(&Pool{Name: "overlap", Ranges: []string{"10.0.0.6-10.0.0.9"}}); err == nil {
+		t.Error("expected overlapping pools to be rejected")
+	}
+	if err := im.NewCidr("10.0.0.0/28"); err == nil {
+		t.Error("expected an overlapping cidr to be rejected")
+	}
+
+	changed, err := im.Reserve(map[string][]string{
+		"node/a":       {"10.0.0.1", "192.168.0.1"},
+		"ippool/pods":  {"10.0.0.2/31"},
+		"service-cidr": {"10.96.0.0/12"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changed) != 1 || changed[0] != "public" {
+		t.Errorf("expected public to conflict, got %v", changed)
+	}
+	expected := []string{"ippool/pods 10.0.0.2-10.0.0.3", "node/a 10.0.0.1"}
+	if conflicts := im.Status("public").Conflicts; !equalStrings(conflicts, expected) {
+		t.Errorf("expected %v, got %v", expected, conflicts)
+	}
+	if im.AcquireSpecificIP("10.0.0.1", owner("default/a")) {
+		t.Error("the node address 10.0.0.1 should not be handed out")
+	}
+	if ip, _ := im.AcquireIP(owner("default/a"), corev1.IPv4Protocol); ip != "10.0.0.4" {
+		t.Errorf("expected 10.0.0.4, got %s", ip)
+	}
+
+	if changed, _ := im.Reserve(nil); len(changed) != 1 {
+		t.Errorf("expected the conflicts of public to go away, got %v", changed)
+	}
+	if ip, _ := im.AcquireIP(owner("default/b"), corev1.IPv4Protocol); ip != "10.0.0.1" {
+		t.Errorf("expected 10.0.0.1, got %s", ip)
+	}
+}
+
+func TestNamespaceUsage(t *testing.T) {
+	im := NewIPAMManager(NewMemoryStore())
+	for _, p := range []*Pool{{Name: "public", Cidr: "10.0.0.0/29"}, {Name: "private", Cidr: "10.0.1.0/29"}} {
+		if err := im.AddPool(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, req := range []*Request{
+		{Owner: "team/a", SharingKey: "team/key", Ports: []string{"TCP/80"}},
+		{Owner: "team/b", SharingKey: "team/key", Ports: []string{"TCP/443"}},
+		{Owner: "team/c", SkipPools: []string{"public"}},
+		{Owner: "other/a"},
+	} {
+		if _, err := im.AcquireIP(req, corev1.IPv4Protocol); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	usage := im.NamespaceUsage("team")
+	if usage["public"] != 1 || usage["private"] != 1 {
+		t.Errorf("expected one ip per pool, got %v", usage)
+	}
+	if im.AcquireSpecificIP("10.0.0.5", &Request{Owner: "team/d", SkipPools: []string{"public"}}) {
+		t.Error("skipped pools should take no new holders")
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	clock := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	now := func() time.Time { return clock }
+	selector, err := labels.Parse("team=a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	im := NewIPAMManager(NewMemoryStore())
+	im.Quarantine = time.Hour
+	im.now = now
+	if err := im.AddPool(&Pool{Name: "a", Ranges: []string{"10.0.0.1-10.0.0.5"}, Strategy: StrategyRandom, ServiceSelector: selector}); err != nil {
+		t.Fatal(err)
+	}
+	if err := im.NewCidr("10.1.0.0/30"); err != nil {
+		t.Fatal(err)
+	}
+	req := &Request{Owner: "default/a", Labels: labels.Set{"team": "a"}, Pools: []string{"a"}}
+	if !im.AcquireSpecificIP("10.0.0.2", req) || !im.AcquireSpecificIP("10.0.0.3", req) {
+		t.Fatal("expected to acquire 10.0.0.2 and 10.0.0.3")
+	}
+	if err := im.ReleaseIP("10.0.0.3", "default/a"); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := im.Export()
+
+	for name, store := range newStores(t) {
+		restored := NewIPAMManager(store)
+		restored.Quarantine = time.Hour
+		restored.now = now
+		// The state of an existing pool is replaced by the snapshot, unless
+		// it has allocations the snapshot does not have.
+		if err := restored.AddPool(&Pool{Name: "a", Ranges: []string{"10.0.0.1-10.0.0.5"}}); err != nil {
+			t.Fatal(name, err)
+		}
+		if !restored.AcquireSpecificIP("10.0.0.4", owner("default/b")) {
+			t.Fatal(name, "expected to acquire 10.0.0.4")
+		}
+		if err := restored.Import(snapshot); err == nil {
+			t.Errorf("%s: expected the allocation of default/b to keep the snapshot from being imported", name)
+		}
+		if restored.HasPool(PoolName("10.1.0.0/30")) {
+			t.Errorf("%s: expected a refused snapshot to add no pool", name)
+		}
+		if err := restored.ReleaseIP("10.0.0.4", "default/b"); err != nil {
+			t.Fatal(name, err)
+		}
+		if err := restored.Import(snapshot); err != nil {
+			t.Fatal(name, err)
+		}
+
+		if !restored.IsCalicoPool(PoolName("10.1.0.0/30")) {
+			t.Errorf("%s: expected the calico pool to be restored", name)
+		}
+		if ips := restored.Held(req, corev1.IPv4Protocol); !equalStrings(ips, []string{"10.0.0.2"}) {
+			t.Errorf("%s: expected default/a to hold 10.0.0.2, got %v", name, ips)
+		}
+		if restored.AcquireSpecificIP("10.0.0.3", owner("default/c")) {
+			t.Errorf("%s: quarantined 10.0.0.3 should not be handed out", name)
+		}
+		if !restored.AcquireSpecificIP("10.0.0.4", owner("default/c")) {
+			t.Errorf("%s: 10.0.0.4 is not held in the snapshot", name)
+		}
+
+		flush(t, restored)
+		// The restored state is persisted.
+		restarted := NewIPAMManager(store)
+		if err := restarted.AddPool(&Pool{Name: "a", Ranges: []string{"10.0.0.1-10.0.0.5"}}); err != nil {
+			t.Fatal(name, err)
+		}
+		if status := restarted.Status("a"); status.Used != 2 {
+			t.Errorf("%s: expected 2 restored allocations, got %d", name, status.Used)
+		}
+	}
+
+	snapshot.Version++
+	if err := NewIPAMManager(NewMemoryStore()).Import(snapshot); err == nil {
+		t.Error("expected an unsupported snapshot version to be refused")
+	}
+}
+
+func TestImportIsAtomic(t *testing.T) {
+	im := NewIPAMManager(NewMemoryStore())
+	for _, p := range []*Pool{{Name: "a", Cidr: "10.0.0.0/29"}, {Name: "c", Cidr: "10.0.1.0/29"}} {
+		if err := im.AddPool(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !im.AcquireSpecificIP("10.0.0.2", owner("ns/x")) {
+		t.Fatal("expected to acquire 10.0.0.2")
+	}
+	snapshot := &Snapshot{Version: SnapshotVersion}
+	for _, ps := range im.Export().Pools {
+		if ps.Name == "a" {
+			ps.State.Allocations["10.0.0.3"] = newAllocation(owner("ns/y"))
+			snapshot.Pools = append(snapshot.Pools, ps)
+		}
+	}
+	// Pool b overlaps pool c, which is not part of the snapshot.
+	snapshot.Pools = append(snapshot.Pools, PoolSnapshot{Name: "b", Cidr: "10.0.1.0/30", State: newPoolState("b")})
+
+	if err := im.Import(snapshot); err == nil || !strings.Contains(err.Error(), "overlaps") {
+		t.Fatalf("expected pool b to be refused for overlapping pool c, got %v", err)
+	}
+	if holders := im.Holders("10.0.0.2"); !equalStrings(holders, []string{"ns/x"}) {
+		t.Errorf("expected ns/x to keep 10.0.0.2, got %v", holders)
+	}
+	if holders := im.Holders("10.0.0.3"); holders != nil {
+		t.Errorf("expected 10.0.0.3 to stay free, got %v", holders)
+	}
+	if im.HasPool("b") {
+		t.Error("expected pool b not to be added")
+	}
+}
+
+func TestConcurrentUse(t *testing.T) {
+	im := NewIPAMManager(NewMemoryStore())
+	for _, p := range []*Pool{
+		{Name: "a", Cidr: "10.0.0.0/24"},
+		{Name: "b", Cidr: "10.0.1.0/24"},
+		{Name: "c", Cidr: "fd00::/120"},
+	} {
+		if err := im.AddPool(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	holders := make(map[string]string)
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := owner(fmt.Sprintf("default/svc-%d", i))
+			family := corev1.IPv4Protocol
+			if i%4 == 0 {
+				family = corev1.IPv6Protocol
+			}
+			ip, err := im.AcquireIP(req, family)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			if other, ok := holders[ip]; ok {
+				t.Errorf("%s handed out to %s and %s", ip, other, req.Owner)
+			}
+			holders[ip] = req.Owner
+			mu.Unlock()
+			im.Status(im.PoolOf(ip))
+			if i%2 == 1 {
+				mu.Lock()
+				delete(holders, ip)
+				mu.Unlock()
+				if _, err := im.ReleaseOwner(req.Owner); err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	used := 0
+	for _, name := range []string{"a", "b", "c"} {
+		used += int(im.Status(name).Used)
+	}
+	if used != len(holders) {
+		t.Errorf("expected %d allocations, got %d", len(holders), used)
+	}
+}
+
+func TestPrefixTrie(t *testing.T) {
+	im := NewIPAMManager(NewMemoryStore())
+	for _, p := range []*Pool{
+		{Name: "a", Cidr: "10.0.0.0/24"},
+		{Name: "b", Ranges: []string{"10.0.1.3-10.0.1.200"}},
+		{Name: "c", Cidr: "fd00::/64"},
+		{Name: "d", Cidr: "0.0.0.0/31"},
+	} {
+		if err := im.AddPool(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for ip, pool := range map[string]string{
+		"10.0.0.0":     "a",
+		"10.0.0.255":   "a",
+		"10.0.1.2":     "",
+		"10.0.1.3":     "b",
+		"10.0.1.128":   "b",
+		"10.0.1.200":   "b",
+		"10.0.1.201":   "",
+		"fd00::1":      "c",
+		"fd00:0:0:1::": "",
+		"0.0.0.1":      "d",
+		"::":           "",
+		"not an ip":    "",
+	} {
+		if got := im.PoolOf(ip); got != pool {
+			t.Errorf("expected %s to be in pool %q, got %q", ip, pool, got)
+		}
+	}
+
+	for _, p := range []*Pool{
+		{Name: "inside", Cidr: "10.0.0.128/25"},
+		{Name: "around", Cidr: "10.0.0.0/16"},
+		{Name: "range", Ranges: []string{"10.0.1.200-10.0.1.210"}},
+	} {
+		if err := im.AddPool(p); err == nil {
+			t.Errorf("expected pool %s to overlap", p.Name)
+		}
+	}
+
+	if err := im.RemovePool("b"); err != nil {
+		t.Fatal(err)
+	}
+	if pool := im.PoolOf("10.0.1.128"); pool != "" {
+		t.Errorf("expected no pool once b is removed, got %q", pool)
+	}
+	if err := im.AddPool(&Pool{Name: "e", Cidr: "10.0.1.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+	if pool := im.PoolOf("10.0.1.128"); pool != "e" {
+		t.Errorf("expected 10.0.1.128 to be in pool e, got %q", pool)
+	}
+}
+
+// benchmarkPools returns a manager with 2048 IPv4 and 1024 IPv6 pools, and
+// allocations for the given number of services spread over the IPv4 pools.
+func benchmarkPools(b *testing.B, allocations int) (*IPAMManager, []string) {
+	im := NewIPAMManager(NewMemoryStore())
+	for i := 0; i < 2048; i++ {
+		cidr := fmt.Sprintf("10.%d.%d.0/24", i/256, i%256)
+		if err := im.AddPool(&Pool{Name: cidr, Cidr: cidr}); err != nil {
+			b.Fatal(err)
+		}
+	}
+	for i := 0; i < 1024; i++ {
+		cidr := fmt.Sprintf("fd00:%x::/120", i)
+		if err := im.AddPool(&Pool{Name: cidr, Cidr: cidr}); err != nil {
+			b.Fatal(err)
+		}
+	}
+	ips := make([]string, 0, allocations)
+	for i := 0; i < allocations; i++ {
+		pool := i % 2048
+		ip := fmt.Sprintf("10.%d.%d.%d", pool/256, pool%256, i/2048+1)
+		if !im.AddUsedIP(ip, owner(fmt.Sprintf("default/svc-%d", i))) {
+			b.Fatalf("failed to restore %s", ip)
+		}
+		ips = append(ips, ip)
+	}
+	return im, ips
+}
+
+var (
+	largeOnce sync.Once
+	largeIPAM *IPAMManager
+	largeIPs  []string
+)
+
+// largePools returns the manager of benchmarkPools with 200000 allocations,
+// it is built once and shared by the benchmarks, which leave its allocations
+// as they found them.
+func largePools(b *testing.B) (*IPAMManager, []string) {
+	largeOnce.Do(func() {
+		largeIPAM, largeIPs = benchmarkPools(b, 200000)
+	})
+	if largeIPAM == nil {
+		b.Fatal("failed to set up the pools")
+	}
+	return largeIPAM, largeIPs
+}
+
+func BenchmarkAddPools(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		benchmarkPools(b, 0)
+	}
+}
+
+func BenchmarkRestore(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		benchmarkPools(b, 20000)
+	}
+}
+
+// singlePool returns a manager with a single /16 pool holding allocations
+// ips, restored through the store like after a restart.
+func singlePool(b *testing.B, allocations int) (*IPAMManager, []string) {
+	store := NewMemoryStore()
+	state := newPoolState("large")
+	ips := make([]string, 0, allocations)
+	for i := 1; i <= allocations; i++ {
+		ip := fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+		state.Allocations[ip] = newAllocation(owner(fmt.Sprintf("default/svc-%d", i)))
+		ips = append(ips, ip)
+	}
+	if err := store.Save(state); err != nil {
+		b.Fatal(err)
+	}
+	im := NewIPAMManager(store)
+	if err := im.AddPool(&Pool{Name: "large", Cidr: "10.0.0.0/16"}); err != nil {
+		b.Fatal(err)
+	}
+	return im, ips
+}
+
+// BenchmarkRestoreSinglePool restores 20000 allocations into a single /16
+// from the status of their services, one at a time.
+func BenchmarkRestoreSinglePool(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		im := NewIPAMManager(NewMemoryStore())
+		if err := im.AddPool(&Pool{Name: "large", Cidr: "10.0.0.0/16"}); err != nil {
+			b.Fatal(err)
+		}
+		err := im.Batch(func() {
+			for j := 1; j <= 20000; j++ {
+				ip := fmt.Sprintf("10.0.%d.%d", j/256, j%256)
+				if !im.AddUsedIP(ip, owner(fmt.Sprintf("default/svc-%d", j))) {
+					b.Fatalf("failed to restore %s", ip)
+				}
+			}
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkLoadSinglePool adds a /16 pool whose 20000 allocations are
+// loaded from the store.
+func BenchmarkLoadSinglePool(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		singlePool(b, 20000)
+	}
+}
+
+// BenchmarkAcquireIPSinglePool acquires and releases ips of a /16 holding
+// 20000 allocations.
+func BenchmarkAcquireIPSinglePool(b *testing.B) {
+	im, _ := singlePool(b, 20000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req := owner(fmt.Sprintf("default/new-%d", i))
+		ip, err := im.AcquireIP(req, corev1.IPv4Protocol)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := im.ReleaseIP(ip, req.Owner); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkAcquireSpecificIPSinglePool gives the ips of a /16 holding 20000
+// allocations back to their holders.
+func BenchmarkAcquireSpecificIPSinglePool(b *testing.B) {
+	im, ips := singlePool(b, 20000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ip := ips[i%len(ips)]
+		req := owner(fmt.Sprintf("default/svc-%d", i%len(ips)+1))
+		if err := im.ReleaseIP(ip, req.Owner); err != nil {
+			b.Fatal(err)
+		}
+		if !im.AcquireSpecificIP(ip, req) {
+			b.Fatalf("failed to acquire %s", ip)
+		}
+	}
+}
+
+func BenchmarkPoolOf(b *testing.B) {
+	im, ips := largePools(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if im.PoolOf(ips[i%len(ips)]) == "" {
+			b.Fatalf("no pool for %s", ips[i%len(ips)])
+		}
+	}
+}
+
+func BenchmarkAcquireSpecificIP(b *testing.B) {
+	im, ips := largePools(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ip := ips[i%len(ips)]
+		req := owner(fmt.Sprintf("default/svc-%d", i%len(ips)))
+		if err := im.ReleaseIP(ip, req.Owner); err != nil {
+			b.Fatal(err)
+		}
+		if !im.AcquireSpecificIP(ip, req) {
+			b.Fatalf("failed to acquire %s", ip)
+		}
+	}
+}
+
+func BenchmarkAcquireIP(b *testing.B) {
+	im, _ := largePools(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req := owner(fmt.Sprintf("default/new-%d", i))
+		ip, err := im.AcquireIP(req, corev1.IPv6Protocol)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := im.ReleaseIP(ip, req.Owner); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestIPSet(t *testing.T) {
+	var set ipSet
+	for _, r := range []string{"10.0.0.5", "10.0.0.1-10.0.0.3", "10.0.0.4", "10.0.0.9", "fd00::1", "10.0.0.7-10.0.0.8"} {
+		parsed, err := parseRange(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		set.add(parsed)
+	}
+	ranges := func() []string {
+		var out []string
+		for _, r := range set {
+			out = append(out, r.String())
+		}
+		return out
+	}
+	if want := []string{"10.0.0.1-10.0.0.5", "10.0.0.7-10.0.0.9", "fd00::1"}; !reflect.DeepEqual(ranges(), want) {
+		t.Errorf("expected %v, got %v", want, ranges())
+	}
+	if r, ok := set.covering(net.ParseIP("10.0.0.8")); !ok || r.String() != "10.0.0.7-10.0.0.9" {
+		t.Errorf("expected 10.0.0.8 to be covered by 10.0.0.7-10.0.0.9, got %v %v", r, ok)
+	}
+	if _, ok := set.covering(net.ParseIP("10.0.0.6")); ok {
+		t.Error("expected 10.0.0.6 not to be covered")
+	}
+
+	for _, ip := range []string{"10.0.0.3", "10.0.0.1", "10.0.0.9", "fd00::1", "10.0.0.6"} {
+		set.remove(net.ParseIP(ip))
+	}
+	if want := []string{"10.0.0.2", "10.0.0.4-10.0.0.5", "10.0.0.7-10.0.0.8"}; !reflect.DeepEqual(ranges(), want) {
+		t.Errorf("expected %v, got %v", want, ranges())
+	}
+}
+
+// hookStore calls save before every Save.
+type hookStore struct {
+	Store
+	save func(state *PoolState) error
+}
+
+func (s *hookStore) Save(state *PoolState) error {
+	if err := s.save(state); err != nil {
+		return err
+	}
+	return s.Store.Save(state)
+}
+
+func TestBatch(t *testing.T) {
+	var lock sync.Mutex
+	saves := 0
+	store := &hookStore{Store: NewMemoryStore(), save: func(state *PoolState) error {
+		lock.Lock()
+		defer lock.Unlock()
+		saves++
+		return nil
+	}}
+	im := NewIPAMManager(store)
+	if err := im.AddPool(&Pool{Name: "a", Cidr: "10.0.0.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+	// The background flush of the pool is over before the batch starts.
+	for flushing := true; flushing; {
+		im.dirtyLock.Lock()
+		flushing = im.flushing
+		im.dirtyLock.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+	lock.Lock()
+	saves = 0
+	lock.Unlock()
+
+	err := im.Batch(func() {
+		for i := 1; i < 100; i++ {
+			if !im.AddUsedIP(fmt.Sprintf("10.0.0.%d", i), owner(fmt.Sprintf("default/svc-%d", i))) {
+				t.Errorf("failed to restore 10.0.0.%d", i)
+			}
+		}
+		// Nothing is saved before the batch is over.
+		time.Sleep(10 * time.Millisecond)
+		lock.Lock()
+		defer lock.Unlock()
+		if saves != 0 {
+			t.Errorf("expected no save during the batch, got %d", saves)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if saves != 1 {
+		t.Errorf("expected a single save, got %d", saves)
+	}
+	state, err := store.Load("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Allocations) != 99 {
+		t.Errorf("expected 99 allocations saved, got %d", len(state.Allocations))
+	}
+}
+
+func TestSaveFailure(t *testing.T) {
+	var lock sync.Mutex
+	failing := true
+	store := &hookStore{Store: NewMemoryStore(), save: func(state *PoolState) error {
+		lock.Lock()
+		defer lock.Unlock()
+		if failing {
+			return fmt.Errorf("store unavailable")
+		}
+		return nil
+	}}
+	im := NewIPAMManager(store)
+	before := testutil.ToFloat64(saveFailures.WithLabelValues("failing"))
+	if err := im.AddPool(&Pool{Name: "failing", Cidr: "10.0.0.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := im.Flush(); err == nil {
+		t.Fatal("expected the save to fail")
+	}
+	if failures := testutil.ToFloat64(saveFailures.WithLabelValues("failing")); failures <= before {
+		t.Errorf("expected the failure to be counted, got %v", failures-before)
+	}
+
+	// The pool is saved once the store is back.
+	lock.Lock()
+	failing = false
+	lock.Unlock()
+	flush(t, im)
+	state, err := store.Load("failing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Cidr != "10.0.0.0/24" {
+		t.Errorf("expected the pool to be saved, got %+v", state)
+	}
+}
+
+func TestSaveOutsideLocks(t *testing.T) {
+	var im *IPAMManager
+	// Saving with the pool locked deadlocks here.
+	store := &hookStore{Store: NewMemoryStore(), save: func(state *PoolState) error {
+		im.Holders("10.0.0.10")
+		return nil
+	}}
+	im = NewIPAMManager(store)
+	if err := im.NewCidr("10.0.0.0/24"); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		if !im.AcquireSpecificIP("10.0.0.10", owner("default/a")) {
+			done <- fmt.Errorf("expected to acquire 10.0.0.10")
+			return
+		}
+		done <- im.Flush()
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("saving deadlocked")
+	}
+	state, err := store.Load(PoolName("10.0.0.0/24"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := state.Allocations["10.0.0.10"]; !ok {
+		t.Errorf("expected 10.0.0.10 to be saved, got %+v", state)
+	}
+}
+
+func TestFlushRetry(t *testing.T) {
+	var lock sync.Mutex
+	failing := true
+	store := &hookStore{Store: NewMemoryStore(), save: func(state *PoolState) error {
+		lock.Lock()
+		defer lock.Unlock()
+		if failing {
+			return fmt.Errorf("store unavailable")
+		}
+		return nil
+	}}
+	im := NewIPAMManager(store)
+	if err := im.NewCidr("10.0.0.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	if !im.AcquireSpecificIP("10.0.0.10", owner("default/a")) {
+		t.Fatal("expected to acquire 10.0.0.10")
+	}
+	if err := im.Flush(); err == nil {
+		t.Fatal("expected the flush to fail")
+	}
+
+	// The pool is saved once the store is back.
+	lock.Lock()
+	failing = false
+	lock.Unlock()
+	flush(t, im)
+	state, err := store.Load(PoolName("10.0.0.0/24"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := state.Allocations["10.0.0.10"]; !ok {
+		t.Errorf("expected 10.0.0.10 to be saved, got %+v", state)
+	}
+}
+
+// BenchmarkAcquireIPFullPool acquires the last free ips of a /20 whose other
+// addresses are all held.
+func BenchmarkAcquireIPFullPool(b *testing.B) {
+	im := NewIPAMManager(NewMemoryStore())
+	if err := im.NewCidr("10.0.0.0/20"); err != nil {
+		b.Fatal(err)
+	}
+	for i := 1; i < 4096-16; i++ {
+		ip := fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+		if !im.AddUsedIP(ip, owner(fmt.Sprintf("default/svc-%d", i))) {
+			b.Fatalf("failed to restore %s", ip)
+		}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req := owner(fmt.Sprintf("default/new-%d", i))
+		ip, err := im.AcquireIP(req, corev1.IPv4Protocol)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := im.ReleaseIP(ip, req.Owner); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestSeveralIPs(t *testing.T) {
+	im := NewIPAMManager(NewMemoryStore())
+	if err := im.NewCidr("10.0.0.0/29"); err != nil {
+		t.Fatal(err)
+	}
+	tcp := &Request{Owner: "default/tcp", SharingKey: "default/dns", Ports: []string{"TCP/53"}}
+	udp := &Request{Owner: "default/udp", SharingKey: "default/dns", Ports: []string{"UDP/53"}}
+
+	var ips []string
+	for i := 0; i < 2; i++ {
+		ip, err := im.AcquireIP(tcp, corev1.IPv4Protocol)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ips = append(ips, ip)
+	}
+	if ips[0] == ips[1] {
+		t.Fatalf("expected two ips, got %v", ips)
+	}
+	// The second service shares both ips, one after the other.
+	var shared []string
+	for i := 0; i < 2; i++ {
+		ip, err := im.AcquireIP(udp, corev1.IPv4Protocol)
+		if err != nil {
+			t.Fatal(err)
+		}
+		shared = append(shared, ip)
+	}
+	if held := im.Held(udp, corev1.IPv4Protocol); !equalStrings(held, im.Held(tcp, corev1.IPv4Protocol)) || len(held) != 2 {
+		t.Errorf("expected default/udp to share %v, got %v", ips, shared)
+	}
+	if ip, err := im.AcquireIP(udp, corev1.IPv4Protocol); err != nil || containsString(ips, ip) {
+		t.Errorf("expected a third ip, got %s %v", ip, err)
+	}
+}
+
+func TestSubnetDelegation(t *testing.T) {
+	im := NewIPAMManager(NewMemoryStore())
+	if err := im.AddPool(&Pool{Name: "public", Cidr: "10.0.0.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+	// 10.0.0.1 is held by another namespace, the first free /28 follows it.
+	if ip, err := im.AcquireIP(owner("other/web"), corev1.IPv4Protocol); err != nil || ip != "10.0.0.1" {
+		t.Fatalf("expected 10.0.0.1, got %s %v", ip, err)
+	}
+	cidr, err := im.Delegate(&Delegation{Name: "tenant", Pool: "public", Namespace: "tenant", PrefixLength: 28})
+	if err != nil || cidr != "10.0.0.16/28" {
+		t.Fatalf("expected 10.0.0.16/28, got %s %v", cidr, err)
+	}
+	if again, err := im.Delegate(&Delegation{Name: "tenant", Pool: "public", Namespace: "tenant", PrefixLength: 28}); err != nil || again != cidr {
+		t.Errorf("expected delegating again to keep %s, got %s %v", cidr, again, err)
+	}
+	if _, err := im.Delegate(&Delegation{Name: "overlap", Pool: "public", Namespace: "x", Cidr: "10.0.0.0/27"}); err == nil {
+		t.Error("expected overlapping delegation to fail")
+	}
+	if _, err := im.Delegate(&Delegation{Name: "held", Pool: "public", Namespace: "x", Cidr: "10.0.0.0/30"}); err == nil {
+		t.Error("expected delegating an ip of another namespace to fail")
+	}
+	if _, err := im.Delegate(&Delegation{Name: "outside", Pool: "public", Namespace: "x", Cidr: "10.0.1.0/28"}); err == nil {
+		t.Error("expected delegation outside of the pool to fail")
+	}
+
+	_, block, _ := net.ParseCIDR(cidr)
+	for i := 0; i < 16; i++ {
+		ip, err := im.AcquireIP(owner(fmt.Sprintf("tenant/svc-%d", i)), corev1.IPv4Protocol)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !block.Contains(net.ParseIP(ip)) {
+			t.Fatalf("expected an ip of %s, got %s", cidr, ip)
+		}
+	}
+	if ip, err := im.AcquireIP(owner("tenant/full"), corev1.IPv4Protocol); err == nil {
+		t.Errorf("expected the delegation to be used up, got %s", ip)
+	}
+	if im.AcquireSpecificIP("10.0.0.40", owner("tenant/specific")) {
+		t.Error("expected tenant to only get ips of its delegation")
+	}
+	status := im.DelegationStatus("tenant")
+	if status == nil || status.Total != 16 || status.Used != 16 || status.Free != 0 {
+		t.Errorf("unexpected delegation status %+v", status)
+	}
+
+	// Other namespaces skip the delegated block.
+	if _, err := im.ReleaseOwner("tenant/svc-0"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 16; i++ {
+		if ip, err := im.AcquireIP(owner(fmt.Sprintf("other/svc-%d", i)), corev1.IPv4Protocol); err != nil || ip == "10.0.0.16" {
+			t.Fatalf("expected an ip outside of %s, got %s %v", cidr, ip, err)
+		}
+	}
+	if im.AcquireSpecificIP("10.0.0.16", owner("other/specific")) {
+		t.Error("expected a delegated ip to be refused to another namespace")
+	}
+
+	// Once undelegated the ips stay with their holders and the block is
+	// open to everyone.
+	im.Undelegate("tenant")
+	if im.DelegationStatus("tenant") != nil {
+		t.Error("expected the delegation to be gone")
+	}
+	if !im.AcquireSpecificIP("10.0.0.16", owner("other/specific")) {
+		t.Error("expected 10.0.0.16 to be free for everyone")
+	}
+	if held := im.Held(owner("tenant/svc-1"), corev1.IPv4Protocol); len(held) != 1 {
+		t.Errorf("expected tenant/svc-1 to keep its ip, got %v", held)
+	}
+}
+
+func TestPoolPriority(t *testing.T) {
+	im := NewIPAMManager(NewMemoryStore())
+	for _, p := range []*Pool{
+		{Name: "low", Cidr: "10.0.0.0/29"},
+		{Name: "rack-a", Cidr: "10.0.1.0/24", Priority: 10, Weight: 2},
+		{Name: "rack-b", Cidr: "10.0.2.0/24", Priority: 10},
+	} {
+		if err := im.AddPool(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Pools of a higher priority fill first, in the order they were added.
+	if ip, err := im.AcquireIP(owner("a"), corev1.IPv4Protocol); err != nil || im.PoolOf(ip) != "rack-a" {
+		t.Fatalf("expected an ip of rack-a, got %s %v", ip, err)
+	}
+	if _, err := im.ReleaseOwner("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	im.Spread = true
+	counts := make(map[string]int)
+	for i := 0; i < 30; i++ {
+		ip, err := im.AcquireIP(owner(fmt.Sprintf("svc-%d", i)), corev1.IPv4Protocol)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[im.PoolOf(ip)]++
+	}
+	if counts["rack-a"] != 20 || counts["rack-b"] != 10 || counts["low"] != 0 {
+		t.Errorf("expected 20 ips of rack-a and 10 of rack-b, got %v", counts)
+	}
+
+	// Lowering the priority of a pool moves it behind the others.
+	if err := im.UpdatePool(&Pool{Name: "rack-a", Cidr: "10.0.1.0/24", Weight: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if ip, err := im.AcquireIP(owner("b"), corev1.IPv4Protocol); err != nil || im.PoolOf(ip) != "rack-b" {
+		t.Errorf("expected an ip of rack-b, got %s %v", ip, err)
+	}
+	// Pools asked for are tried in the order asked for.
+	req := &Request{Owner: "c", Pools: []string{"low", "rack-b"}}
+	if ip, err := im.AcquireIP(req, corev1.IPv4Protocol); err != nil || im.PoolOf(ip) != "low" {
+		t.Errorf("expected an ip of low, got %s %v", ip, err)
+	}
+}
+
+func TestManualPool(t *testing.T) {
+	im := NewIPAMManager(NewMemoryStore())
+	if err := im.AddPool(&Pool{Name: "vanity", Cidr: "10.0.0.0/30", Priority: 10, Manual: true}); err != nil {
+		t.Fatal(err)
+	}
+	if ip, err := im.AcquireIP(owner("a"), corev1.IPv4Protocol); err == nil {
+		t.Fatalf("expected no ip of a manual pool, got %s", ip)
+	}
+	if err := im.AddPool(&Pool{Name: "public", Cidr: "10.0.1.0/30"}); err != nil {
+		t.Fatal(err)
+	}
+	if ip, err := im.AcquireIP(owner("a"), corev1.IPv4Protocol); err != nil || ip != "10.0.1.1" {
+		t.Errorf("expected 10.0.1.1, got %s %v", ip, err)
+	}
+	// Manual pools hand out ips asked for, by pool or by address.
+	req := &Request{Owner: "b", Pools: []string{"vanity"}}
+	if ip, err := im.AcquireIP(req, corev1.IPv4Protocol); err != nil || ip != "10.0.0.1" {
+		t.Errorf("expected 10.0.0.1, got %s %v", ip, err)
+	}
+	if !im.AcquireSpecificIP("10.0.0.2", owner("c")) {
+		t.Error("expected 10.0.0.2 to be handed out when asked for")
+	}
+}
+
+func TestOwners(t *testing.T) {
+	im := NewIPAMManager(NewMemoryStore())
+	if err := im.NewCidr("10.0.0.0/29"); err != nil {
+		t.Fatal(err)
+	}
+	if err := im.NewCidr("fd00::/125"); err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range []corev1.IPFamily{corev1.IPv4Protocol, corev1.IPv6Protocol} {
+		if _, err := im.AcquireIP(owner("default/a"), family); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := im.AcquireIP(owner("default/b"), corev1.IPv4Protocol); err != nil {
+		t.Fatal(err)
+	}
+	owners := im.Owners()
+	if len(owners) != 2 || !equalStrings(owners["default/a"], []string{"10.0.0.1", "fd00::1"}) || !equalStrings(owners["default/b"], []string{"10.0.0.2"}) {
+		t.Errorf("unexpected owners %v", owners)
+	}
+}
+
+func TestHolders(t *testing.T) {
+	im := NewIPAMManager(NewMemoryStore())
+	if err := im.NewCidr("10.0.0.0/29"); err != nil {
+		t.Fatal(err)
+	}
+	if holders := im.Holders("10.0.0.1"); holders != nil {
+		t.Errorf("expected no holders, got %v", holders)
+	}
+	for _, name := range []string{"default/b", "default/a"} {
+		req := &Request{Owner: name, SharingKey: "default/dns", Ports: []string{"TCP/" + name}}
+		if !im.AddUsedIP("10.0.0.1", req) {
+			t.Fatalf("expected %s to hold 10.0.0.1", name)
+		}
+	}
+	if im.AddUsedIP("10.0.0.1", owner("default/c")) {
+		t.Error("expected default/c not to share 10.0.0.1")
+	}
+	if holders := im.Holders("10.0.0.1"); !equalStrings(holders, []string{"default/a", "default/b"}) {
+		t.Errorf("unexpected holders %v", holders)
+	}
+	if holders := im.Holders("192.168.0.1"); holders != nil {
+		t.Errorf("expected no holders outside of the pools, got %v", holders)
+	}
+}
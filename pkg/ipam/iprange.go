@@ -0,0 +1,298 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipam
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"net"
+	"sort"
+	"strings"
+)
+
+// ipRange is an inclusive range of addresses of the same family.
+type ipRange struct {
+	first net.IP
+	last  net.IP
+}
+
+// parseRange parses a single ip, a cidr or an inclusive range "first-last".
+func parseRange(s string) (ipRange, error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "/") {
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return ipRange{}, err
+		}
+		return cidrRange(ipnet), nil
+	}
+	parts := strings.SplitN(s, "-", 2)
+	first := normalize(net.ParseIP(strings.TrimSpace(parts[0])))
+	if first == nil {
+		return ipRange{}, fmt.Errorf("invalid ip range %q", s)
+	}
+	last := first
+	if len(parts) == 2 {
+		last = normalize(net.ParseIP(strings.TrimSpace(parts[1])))
+		if last == nil || len(last) != len(first) || bytes.Compare(first, last) > 0 {
+			return ipRange{}, fmt.Errorf("invalid ip range %q", s)
+		}
+	}
+	return ipRange{first: first, last: last}, nil
+}
+
+// cidrRange returns the range covering every address of ipnet.
+func cidrRange(ipnet *net.IPNet) ipRange {
+	first := normalize(ipnet.IP.Mask(ipnet.Mask))
+	last := make(net.IP, len(first))
+	for i := range first {
+		last[i] = first[i] | ^ipnet.Mask[len(ipnet.Mask)-len(first)+i]
+	}
+	return ipRange{first: first, last: last}
+}
+
+func (r ipRange) contains(ip net.IP) bool {
+	ip = normalize(ip)
+	return len(ip) == len(r.first) && bytes.Compare(r.first, ip) <= 0 && bytes.Compare(ip, r.last) <= 0
+}
+
+// size returns the number of addresses in r.
+func (r ipRange) size() *big.Int {
+	n := new(big.Int).Sub(ipToInt(r.last), ipToInt(r.first))
+	return n.Add(n, big.NewInt(1))
+}
+
+func (r ipRange) String() string {
+	if r.first.Equal(r.last) {
+		return r.first.String()
+	}
+	return r.first.String() + "-" + r.last.String()
+}
+
+// cidrs decomposes r into the smallest list of aligned prefixes.
+func (r ipRange) cidrs() []*net.IPNet {
+	bits := len(r.first) * 8
+	var out []*net.IPNet
+	start := ipToInt(r.first)
+	end := ipToInt(r.last)
+	one := big.NewInt(1)
+	for start.Cmp(end) <= 0 {
+		// Grow the block while it stays aligned on start and within r.
+		hostBits := 0
+		for hostBits < bits {
+			block := new(big.Int).Lsh(one, uint(hostBits+1))
+			if new(big.Int).Mod(start, block).Sign() != 0 {
+				break
+			}
+			if last := new(big.Int).Sub(block.Add(block, start), one); last.Cmp(end) > 0 {
+				break
+			}
+			hostBits++
+		}
+		out = append(out, &net.IPNet{IP: intToIP(start, len(r.first)), Mask: net.CIDRMask(bits-hostBits, bits)})
+		start.Add(start, new(big.Int).Lsh(one, uint(hostBits)))
+	}
+	return out
+}
+
+// normalize returns ip in its 4 byte form if it is an IPv4 address.
+func normalize(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return ip
+}
+
+func ipToInt(ip net.IP) *big.Int {
+	return new(big.Int).SetBytes(ip)
+}
+
+func intToIP(n *big.Int, length int) net.IP {
+	ip := make(net.IP, length)
+	b := n.Bytes()
+	copy(ip[length-len(b):], b)
+	return ip
+}
+
+// nextIP returns the address following ip.
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+// prevIP returns the address preceding ip.
+func prevIP(ip net.IP) net.IP {
+	prev := make(net.IP, len(ip))
+	copy(prev, ip)
+	for i := len(prev) - 1; i >= 0; i-- {
+		prev[i]--
+		if prev[i] != 0xff {
+			break
+		}
+	}
+	return prev
+}
+
+// compareIP orders IPv4 addresses before IPv6 ones, then by value.
+func compareIP(a, b net.IP) int {
+	if len(a) != len(b) {
+		if len(a) < len(b) {
+			return -1
+		}
+		return 1
+	}
+	return bytes.Compare(a, b)
+}
+
+// adjacent reports whether b is the address following a.
+func adjacent(a, b net.IP) bool {
+	return len(a) == len(b) && bytes.Equal(nextIP(a), b) && compareIP(a, b) < 0
+}
+
+// ipSet is a set of addresses kept as sorted ranges which neither overlap
+// nor touch, so that a run of addresses is looked up and skipped at once.
+type ipSet []ipRange
+
+// index returns the index of the first range of s not ending before ip.
+func (s ipSet) index(ip net.IP) int {
+	return sort.Search(len(s), func(i int) bool {
+		return compareIP(s[i].last, ip) >= 0
+	})
+}
+
+// covering returns the range of s containing ip.
+func (s ipSet) covering(ip net.IP) (ipRange, bool) {
+	ip = normalize(ip)
+	if i := s.index(ip); i < len(s) && compareIP(s[i].first, ip) <= 0 {
+		return s[i], true
+	}
+	return ipRange{}, false
+}
+
+// add adds the addresses of r to s, merging the ranges r overlaps or
+// touches.
+func (s *ipSet) add(r ipRange) {
+	set := *s
+	i := set.index(r.first)
+	if i > 0 && adjacent(set[i-1].last, r.first) {
+		i--
+	}
+	j := i
+	for j < len(set) && (compareIP(set[j].first, r.last) <= 0 || adjacent(r.last, set[j].first)) {
+		if compareIP(set[j].first, r.first) < 0 {
+			r.first = set[j].first
+		}
+		if compareIP(set[j].last, r.last) > 0 {
+			r.last = set[j].last
+		}
+		j++
+	}
+	if j > i {
+		set[i] = r
+		set = append(set[:i+1], set[j:]...)
+	} else {
+		set = append(set, ipRange{})
+		copy(set[i+1:], set[i:])
+		set[i] = r
+	}
+	*s = set
+}
+
+// remove drops ip from s, splitting the range holding it if need be.
+func (s *ipSet) remove(ip net.IP) {
+	ip = normalize(ip)
+	set := *s
+	i := set.index(ip)
+	if i == len(set) || compareIP(set[i].first, ip) > 0 {
+		return
+	}
+	r := set[i]
+	switch {
+	case bytes.Equal(r.first, r.last):
+		set = append(set[:i], set[i+1:]...)
+	case bytes.Equal(r.first, ip):
+		set[i].first = nextIP(ip)
+	case bytes.Equal(r.last, ip):
+		set[i].last = prevIP(ip)
+	default:
+		set = append(set, ipRange{})
+		copy(set[i+2:], set[i+1:])
+		set[i] = ipRange{first: r.first, last: prevIP(ip)}
+		set[i+1] = ipRange{first: nextIP(ip), last: r.last}
+	}
+	*s = set
+}
+
+// single returns the range made of ip alone.
+func single(ip net.IP) ipRange {
+	ip = normalize(ip)
+	return ipRange{first: ip, last: ip}
+}
+
+// overlapSize returns the number of addresses of r also covered by any of
+// others, which may overlap each other.
+func (r ipRange) overlapSize(others []ipRange) *big.Int {
+	total := new(big.Int)
+	cursor := ipToInt(r.first)
+	end := ipToInt(r.last)
+	for cursor.Cmp(end) <= 0 {
+		// Find the range covering cursor which reaches the furthest.
+		var reach *big.Int
+		for _, o := range others {
+			if len(o.first) != len(r.first) {
+				continue
+			}
+			if ipToInt(o.first).Cmp(cursor) <= 0 && ipToInt(o.last).Cmp(cursor) >= 0 {
+				if last := ipToInt(o.last); reach == nil || last.Cmp(reach) > 0 {
+					reach = last
+				}
+			}
+		}
+		if reach == nil {
+			// Skip to the start of the next range after cursor.
+			var next *big.Int
+			for _, o := range others {
+				if len(o.first) != len(r.first) {
+					continue
+				}
+				if first := ipToInt(o.first); first.Cmp(cursor) > 0 && (next == nil || first.Cmp(next) < 0) {
+					next = first
+				}
+			}
+			if next == nil {
+				break
+			}
+			cursor = next
+			continue
+		}
+		if reach.Cmp(end) > 0 {
+			reach = end
+		}
+		covered := new(big.Int).Sub(reach, cursor)
+		total.Add(total, covered.Add(covered, big.NewInt(1)))
+		cursor = new(big.Int).Add(reach, big.NewInt(1))
+	}
+	return total
+}
@@ -0,0 +1,436 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipam
+
+import (
+	"fmt"
+	"math/big"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/LambdaHJ/bgplb/api/v1beta1"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	// DrainKeep lets the services of a pool being removed keep their ips.
+	DrainKeep = "Keep"
+	// DrainMigrate moves the services of a pool being removed to other pools.
+	DrainMigrate = "Migrate"
+)
+
+const (
+	// StrategySequential hands out the lowest free address.
+	StrategySequential = "sequential"
+	// StrategyRandom hands out a free address at random.
+	StrategyRandom = "random"
+	// StrategyLeastRecentlyReleased hands out addresses never used before
+	// first, then the address released the longest time ago.
+	StrategyLeastRecentlyReleased = "least-recently-released"
+)
+
+// Pool is a named set of addresses ips are acquired from, given as a cidr
+// and/or inclusive ranges.
+type Pool struct {
+	Name   string
+	Cidr   string
+	Ranges []string
+	// Excludes are never handed out, each entry is a single ip, a cidr or an
+	// inclusive range such as 10.0.0.1-10.0.0.9.
+	Excludes []string
+	// AllowNetworkBroadcast lets the first and the last address of Cidr be
+	// handed out, they are skipped by default.
+	AllowNetworkBroadcast bool
+	// DrainPolicy decides what happens to the ips of the pool once it is
+	// removed while still in use, the manager DrainPolicy applies if unset.
+	DrainPolicy string
+	// FromCalico is set for the pools of the cidrs in the Calico
+	// BGPConfiguration, they are not described by a BGPIPsConfig.
+	FromCalico bool
+	// Strategy picks which free address is handed out next, it defaults to
+	// StrategySequential.
+	Strategy string
+	// NamespaceSelector and ServiceSelector limit which services may use the
+	// pool, nil selectors match everything.
+	NamespaceSelector labels.Selector
+	ServiceSelector   labels.Selector
+	// Priority orders the pools, pools of a higher priority are tried first.
+	// Pools of the same priority are tried in the order they were added
+	// unless the manager spreads ips across them.
+	Priority int
+	// Weight is the share of the ips spread across the pools of the same
+	// priority taken by the pool, 1 if unset.
+	Weight int
+	// Manual pools only hand out ips to requests asking for them, through
+	// Request.Pools or AcquireSpecificIP.
+	Manual bool
+}
+
+// Request describes the service an ip is acquired for.
+type Request struct {
+	// Owner is the namespace/name of the service.
+	Owner string
+	// Labels and NamespaceLabels are the labels of the service and of its
+	// namespace, they are matched against the selectors of every pool.
+	Labels          labels.Set
+	NamespaceLabels labels.Set
+	// Pools, when set, are the only pools tried, in order.
+	Pools []string
+	// SkipPools are pools no new ip is taken from, e.g. because the
+	// namespace used up its quota there.
+	SkipPools []string
+	// SharingKey lets the ip be shared with other requests of the same key
+	// as long as their Ports do not overlap.
+	SharingKey string
+	// Ports are the ports used by the service, formatted as protocol/port.
+	Ports []string
+	// ShareOnly only lets the request join ips shareable with it, no ip
+	// nobody holds is acquired, e.g. because the namespace used up its
+	// quota.
+	ShareOnly bool
+}
+
+// PoolFromConfig returns the Pool described by conf.
+func PoolFromConfig(conf *v1beta1.BGPIPsConfig) (*Pool, error) {
+	p := &Pool{
+		Name:                  conf.Name,
+		Cidr:                  conf.Spec.Cidr,
+		Ranges:                conf.Spec.Ranges,
+		Excludes:              conf.Spec.Excludes,
+		AllowNetworkBroadcast: conf.Spec.SkipNetworkBroadcast != nil && !*conf.Spec.SkipNetworkBroadcast,
+		Strategy:              conf.Spec.AllocationStrategy,
+		DrainPolicy:           conf.Spec.DrainPolicy,
+		Priority:              conf.Spec.Priority,
+		Weight:                conf.Spec.Weight,
+		Manual:                conf.Spec.AutoAssign != nil && !*conf.Spec.AutoAssign,
+	}
+	var err error
+	if p.NamespaceSelector, err = toSelector(conf.Spec.NamespaceSelector); err != nil {
+		return nil, err
+	}
+	if p.ServiceSelector, err = toSelector(conf.Spec.ServiceSelector); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Matches reports whether req may acquire ips from the pool.
+func (p *Pool) Matches(req *Request) bool {
+	if p.NamespaceSelector != nil && !p.NamespaceSelector.Matches(req.NamespaceLabels) {
+		return false
+	}
+	if p.ServiceSelector != nil && !p.ServiceSelector.Matches(req.Labels) {
+		return false
+	}
+	return true
+}
+
+// requestedBy reports whether p is one of the pools asked for by req.
+func (p *Pool) requestedBy(req *Request) bool {
+	if len(req.Pools) == 0 {
+		return true
+	}
+	for _, name := range req.Pools {
+		if name == p.Name {
+			return true
+		}
+	}
+	return false
+}
+
+func toSelector(selector *metav1.LabelSelector) (labels.Selector, error) {
+	if selector == nil {
+		return nil, nil
+	}
+	return metav1.LabelSelectorAsSelector(selector)
+}
+
+// pool is a Pool together with its allocation state.
+type pool struct {
+	*Pool
+	// spans are the address ranges of the pool and prefixes their
+	// decomposition into cidrs. reserved are the
+	// addresses of spans which are never handed out.
+	spans    []ipRange
+	prefixes []*net.IPNet
+	reserved ipSet
+	// lock guards state, held and rand while the manager is read locked,
+	// held are the addresses of the allocations of state and rand is only
+	// set for StrategyRandom.
+	lock  sync.Mutex
+	state *PoolState
+	held  ipSet
+	rand  *rand.Rand
+	// draining is set once the pool was removed while still in use, it hands
+	// out no more ips and goes away with its last allocation.
+	draining bool
+	// delegations are the blocks of the pool set aside for a namespace, they
+	// only change while the manager is write locked.
+	delegations []*delegation
+}
+
+func newPool(p *Pool) (*pool, error) {
+	switch p.Strategy {
+	case "", StrategySequential, StrategyRandom, StrategyLeastRecentlyReleased:
+	default:
+		return nil, fmt.Errorf("pool %s has unknown allocation strategy %q", p.Name, p.Strategy)
+	}
+	switch p.DrainPolicy {
+	case "", DrainKeep, DrainMigrate:
+	default:
+		return nil, fmt.Errorf("pool %s has unknown drain policy %q", p.Name, p.DrainPolicy)
+	}
+	if p.Weight < 0 {
+		return nil, fmt.Errorf("pool %s has negative weight %d", p.Name, p.Weight)
+	}
+	np := &pool{Pool: p}
+	if p.Cidr != "" {
+		_, ipnet, err := net.ParseCIDR(p.Cidr)
+		if err != nil {
+			return nil, err
+		}
+		span := cidrRange(ipnet)
+		np.spans = append(np.spans, span)
+		// Prefixes of one or two addresses have no network and broadcast address.
+		if !p.AllowNetworkBroadcast && span.size().Cmp(big.NewInt(2)) > 0 {
+			np.reserved.add(single(span.first))
+			np.reserved.add(single(span.last))
+		}
+	}
+	for _, s := range p.Ranges {
+		span, err := parseRange(s)
+		if err != nil {
+			return nil, err
+		}
+		np.spans = append(np.spans, span)
+	}
+	if len(np.spans) == 0 {
+		return nil, fmt.Errorf("pool %s has neither cidr nor ranges", p.Name)
+	}
+	for i, span := range np.spans {
+		if len(span.first) != len(np.spans[0].first) {
+			return nil, fmt.Errorf("pool %s mixes ip families", p.Name)
+		}
+		if span.overlapSize(np.spans[i+1:]).Sign() > 0 {
+			return nil, fmt.Errorf("pool %s has overlapping ranges", p.Name)
+		}
+		np.prefixes = append(np.prefixes, span.cidrs()...)
+	}
+	for _, exclude := range p.Excludes {
+		r, err := parseRange(exclude)
+		if err != nil {
+			return nil, err
+		}
+		np.reserved.add(r)
+	}
+	return np, nil
+}
+
+// weight returns the weight of p, 1 if unset.
+func (p *pool) weight() int {
+	if p.Weight == 0 {
+		return 1
+	}
+	return p.Weight
+}
+
+func (p *pool) family() corev1.IPFamily {
+	return FamilyOf(p.spans[0].first)
+}
+
+// contains reports whether ip is in one of the spans of p.
+func (p *pool) contains(ip net.IP) bool {
+	for _, span := range p.spans {
+		if span.contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// overlaps reports whether r shares addresses with one of the spans of p.
+func (p *pool) overlaps(r ipRange) bool {
+	for _, span := range p.spans {
+		if span.overlapSize([]ipRange{r}).Sign() > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// prefixOf returns the prefix of p holding ip, or "" if p does not.
+func (p *pool) prefixOf(ip string) string {
+	parsed := net.ParseIP(ip)
+	for _, prefix := range p.prefixes {
+		if prefix.Contains(parsed) {
+			return prefix.String()
+		}
+	}
+	return ""
+}
+
+// usable reports whether ip may be handed out from p.
+func (p *pool) usable(ip net.IP) bool {
+	if !p.contains(ip) {
+		return false
+	}
+	_, reserved := p.reserved.covering(ip)
+	return !reserved
+}
+
+// walk calls fn for every usable address of p nobody holds and skip does not
+// reject, starting at the offset-th address of the pool and wrapping around,
+// until fn returns true. Runs of held and reserved addresses are skipped at
+// once, which keeps filling a pool from scanning it over and over.
+func (p *pool) walk(offset *big.Int, skip func(ip string) bool, fn func(ip net.IP) bool) {
+	start, from := 0, p.spans[0].first
+	rest := new(big.Int).Set(offset)
+	for i, span := range p.spans {
+		if rest.Cmp(span.size()) < 0 {
+			start = i
+			from = intToIP(rest.Add(rest, ipToInt(span.first)), len(span.first))
+			break
+		}
+		rest.Sub(rest, span.size())
+	}
+
+	scan := func(first, last net.IP) bool {
+		for ip := first; ; ip = nextIP(ip) {
+			if r, held := p.held.covering(ip); held {
+				ip = r.last
+			} else if r, reserved := p.reserved.covering(ip); reserved {
+				ip = r.last
+			} else if !skip(ip.String()) && fn(ip) {
+				return true
+			}
+			if compareIP(ip, last) >= 0 {
+				return false
+			}
+		}
+	}
+	if scan(from, p.spans[start].last) {
+		return
+	}
+	for i := 1; i < len(p.spans); i++ {
+		span := p.spans[(start+i)%len(p.spans)]
+		if scan(span.first, span.last) {
+			return
+		}
+	}
+	if span := p.spans[start]; !from.Equal(span.first) {
+		scan(span.first, from)
+	}
+}
+
+// size returns the number of addresses in the spans of p.
+func (p *pool) size() *big.Int {
+	n := new(big.Int)
+	for _, span := range p.spans {
+		n.Add(n, span.size())
+	}
+	return n
+}
+
+// nextFree returns the address handed out next according to the strategy of
+// p, or nil if every address is taken or skipped.
+func (p *pool) nextFree(skip func(ip string) bool) net.IP {
+	var found net.IP
+	switch p.Strategy {
+	case StrategyRandom:
+		p.walk(new(big.Int).Rand(p.rand, p.size()), skip, func(ip net.IP) bool {
+			found = ip
+			return true
+		})
+	case StrategyLeastRecentlyReleased:
+		var oldest time.Time
+		p.walk(new(big.Int), skip, func(ip net.IP) bool {
+			released, ok := p.state.Released[ip.String()]
+			if !ok {
+				found = ip
+				return true
+			}
+			if found == nil || released.At.Before(oldest) {
+				found, oldest = ip, released.At
+			}
+			return false
+		})
+	default:
+		p.walk(new(big.Int), skip, func(ip net.IP) bool {
+			found = ip
+			return true
+		})
+	}
+	return found
+}
+
+// heldIPs returns every ip held by owner.
+func (p *pool) heldIPs(owner string) []string {
+	var ips []string
+	for ip, alloc := range p.state.Allocations {
+		if _, ok := alloc.Owners[owner]; ok {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// heldBy reports whether owner holds ip.
+func (p *pool) heldBy(ip, owner string) bool {
+	alloc, ok := p.state.Allocations[ip]
+	if !ok {
+		return false
+	}
+	_, held := alloc.Owners[owner]
+	return held
+}
+
+// drained reports whether p is draining and has no allocations left.
+func (p *pool) drained() bool {
+	return p.draining && len(p.state.Allocations) == 0
+}
+
+// total returns the number of usable addresses.
+func (p *pool) total() *big.Int {
+	n := p.size()
+	for _, span := range p.spans {
+		n.Sub(n, span.overlapSize(p.reserved))
+	}
+	return n
+}
+
+// free returns the number of usable addresses nobody holds.
+func (p *pool) free() uint {
+	n := p.total()
+	n.Sub(n, big.NewInt(int64(len(p.state.Allocations))))
+	return clampUint(n)
+}
+
+// clampUint returns n as an uint, capped to the range of uint.
+func clampUint(n *big.Int) uint {
+	if n.Sign() < 0 {
+		return 0
+	}
+	if !n.IsUint64() || n.Uint64() > uint64(^uint(0)) {
+		return ^uint(0)
+	}
+	return uint(n.Uint64())
+}
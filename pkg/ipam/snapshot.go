@@ -0,0 +1,289 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipam
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/LambdaHJ/bgplb/api/v1beta1"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// SnapshotVersion is the version of the Snapshot format written by Export.
+const SnapshotVersion = 1
+
+// Snapshot is the full state of an IPAMManager.
+type Snapshot struct {
+	Version int            `json:"version"`
+	Pools   []PoolSnapshot `json:"pools"`
+}
+
+// PoolSnapshot is the definition of a pool together with its allocations
+// and released ips.
+type PoolSnapshot struct {
+	Name                  string     `json:"name"`
+	Cidr                  string     `json:"cidr,omitempty"`
+	Ranges                []string   `json:"ranges,omitempty"`
+	Excludes              []string   `json:"excludes,omitempty"`
+	AllowNetworkBroadcast bool       `json:"allowNetworkBroadcast,omitempty"`
+	Strategy              string     `json:"strategy,omitempty"`
+	DrainPolicy           string     `json:"drainPolicy,omitempty"`
+	Priority              int        `json:"priority,omitempty"`
+	Weight                int        `json:"weight,omitempty"`
+	Manual                bool       `json:"manual,omitempty"`
+	FromCalico            bool       `json:"fromCalico,omitempty"`
+	NamespaceSelector     string     `json:"namespaceSelector,omitempty"`
+	ServiceSelector       string     `json:"serviceSelector,omitempty"`
+	State                 *PoolState `json:"state"`
+}
+
+// Export returns the state of every pool.
+func (im *IPAMManager) Export() *Snapshot {
+	im.lock.RLock()
+	defer im.lock.RUnlock()
+
+	snapshot := &Snapshot{Version: SnapshotVersion, Pools: make([]PoolSnapshot, 0, len(im.pools))}
+	for _, p := range im.pools {
+		ps := PoolSnapshot{
+			Name:                  p.Name,
+			Cidr:                  p.Cidr,
+			Ranges:                p.Ranges,
+			Excludes:              p.Excludes,
+			AllowNetworkBroadcast: p.AllowNetworkBroadcast,
+			Strategy:              p.Strategy,
+			DrainPolicy:           p.DrainPolicy,
+			Priority:              p.Priority,
+			Weight:                p.Weight,
+			Manual:                p.Manual,
+			FromCalico:            p.FromCalico,
+		}
+		p.lock.Lock()
+		ps.State = p.state.deepCopy()
+		p.lock.Unlock()
+		if p.NamespaceSelector != nil {
+			ps.NamespaceSelector = p.NamespaceSelector.String()
+		}
+		if p.ServiceSelector != nil {
+			ps.ServiceSelector = p.ServiceSelector.String()
+		}
+		snapshot.Pools = append(snapshot.Pools, ps)
+	}
+	return snapshot
+}
+
+// Import restores snapshot. Pools which do not exist are added as
+// described by the snapshot, the allocations and released ips of the
+// others are replaced by those of the snapshot. A snapshot which would drop
+// an allocation of the manager, e.g. of a service which got its ip after
+// the snapshot was taken, is refused. Every pool is checked before any is
+// changed, nothing changes unless the whole snapshot can be restored. The
+// changes are flushed like any other, Batch writes them at once.
+func (im *IPAMManager) Import(snapshot *Snapshot) error {
+	if err := snapshot.Validate(); err != nil {
+		return err
+	}
+	im.lock.Lock()
+	defer im.lock.Unlock()
+
+	added := make([]*pool, len(snapshot.Pools))
+	for i, ps := range snapshot.Pools {
+		if p := im.getPool(ps.Name); p != nil {
+			if err := checkRestore(p, ps.State); err != nil {
+				return err
+			}
+			continue
+		}
+		p, err := ps.pool()
+		if err != nil {
+			return err
+		}
+		if added[i], err = im.checkPool(p); err != nil {
+			return err
+		}
+	}
+
+	for i, ps := range snapshot.Pools {
+		p := im.getPool(ps.Name)
+		if p == nil {
+			im.insertNewPool(added[i], newPoolState(ps.Name))
+			p = added[i]
+		}
+		im.restore(p, ps.State)
+	}
+	return nil
+}
+
+// Validate checks that snapshot is of a supported version and that every
+// pool is valid, overlaps no other pool of snapshot, has a state and only
+// allocations and released ips of its own addresses.
+func (snapshot *Snapshot) Validate() error {
+	if snapshot.Version != SnapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", snapshot.Version)
+	}
+	names := make(map[string]bool, len(snapshot.Pools))
+	pools := make([]*pool, 0, len(snapshot.Pools))
+	for _, ps := range snapshot.Pools {
+		if ps.Name == "" {
+			return fmt.Errorf("pool without name")
+		}
+		if names[ps.Name] {
+			return fmt.Errorf("pool %s is listed twice", ps.Name)
+		}
+		names[ps.Name] = true
+		if ps.State == nil {
+			return fmt.Errorf("pool %s has no state", ps.Name)
+		}
+		p, err := ps.pool()
+		if err != nil {
+			return err
+		}
+		checked, err := newPool(p)
+		if err != nil {
+			return err
+		}
+		for _, other := range pools {
+			for _, span := range checked.spans {
+				if other.overlaps(span) {
+					return fmt.Errorf("pool %s overlaps pool %s", ps.Name, other.Name)
+				}
+			}
+		}
+		pools = append(pools, checked)
+		for ip, alloc := range ps.State.Allocations {
+			if checked.prefixOf(ip) == "" {
+				return fmt.Errorf("ip %s is not part of pool %s", ip, ps.Name)
+			}
+			if alloc == nil || len(alloc.Owners) == 0 {
+				return fmt.Errorf("ip %s of pool %s has no holder", ip, ps.Name)
+			}
+		}
+		for ip := range ps.State.Released {
+			if checked.prefixOf(ip) == "" {
+				return fmt.Errorf("released ip %s is not part of pool %s", ip, ps.Name)
+			}
+		}
+	}
+	return nil
+}
+
+func (ps *PoolSnapshot) pool() (*Pool, error) {
+	p := &Pool{
+		Name:                  ps.Name,
+		Cidr:                  ps.Cidr,
+		Ranges:                ps.Ranges,
+		Excludes:              ps.Excludes,
+		AllowNetworkBroadcast: ps.AllowNetworkBroadcast,
+		Strategy:              ps.Strategy,
+		DrainPolicy:           ps.DrainPolicy,
+		Priority:              ps.Priority,
+		Weight:                ps.Weight,
+		Manual:                ps.Manual,
+		FromCalico:            ps.FromCalico,
+	}
+	var err error
+	if ps.NamespaceSelector != "" {
+		if p.NamespaceSelector, err = labels.Parse(ps.NamespaceSelector); err != nil {
+			return nil, fmt.Errorf("pool %s: %v", ps.Name, err)
+		}
+	}
+	if ps.ServiceSelector != "" {
+		if p.ServiceSelector, err = labels.Parse(ps.ServiceSelector); err != nil {
+			return nil, fmt.Errorf("pool %s: %v", ps.Name, err)
+		}
+	}
+	return p, nil
+}
+
+// Config returns the BGPIPsConfig describing the pool of ps.
+func (ps *PoolSnapshot) Config() (*v1beta1.BGPIPsConfig, error) {
+	conf := &v1beta1.BGPIPsConfig{
+		ObjectMeta: metav1.ObjectMeta{Name: ps.Name},
+		Spec: v1beta1.BGPIPsConfigSpec{
+			Cidr:               ps.Cidr,
+			Ranges:             ps.Ranges,
+			Excludes:           ps.Excludes,
+			AllocationStrategy: ps.Strategy,
+			DrainPolicy:        ps.DrainPolicy,
+			Priority:           ps.Priority,
+			Weight:             ps.Weight,
+		},
+	}
+	if ps.AllowNetworkBroadcast {
+		skip := false
+		conf.Spec.SkipNetworkBroadcast = &skip
+	}
+	if ps.Manual {
+		autoAssign := false
+		conf.Spec.AutoAssign = &autoAssign
+	}
+	var err error
+	if ps.NamespaceSelector != "" {
+		if conf.Spec.NamespaceSelector, err = metav1.ParseToLabelSelector(ps.NamespaceSelector); err != nil {
+			return nil, fmt.Errorf("pool %s: %v", ps.Name, err)
+		}
+	}
+	if ps.ServiceSelector != "" {
+		if conf.Spec.ServiceSelector, err = metav1.ParseToLabelSelector(ps.ServiceSelector); err != nil {
+			return nil, fmt.Errorf("pool %s: %v", ps.Name, err)
+		}
+	}
+	return conf, nil
+}
+
+// checkRestore reports why state cannot replace the state of p, which is
+// when an ip of state is not part of p or when an allocation of p is
+// missing from state.
+func checkRestore(p *pool, state *PoolState) error {
+	for ip := range state.Allocations {
+		if p.prefixOf(ip) == "" {
+			return fmt.Errorf("ip %s is not part of pool %s", ip, p.Name)
+		}
+	}
+	for ip, alloc := range p.state.Allocations {
+		var owners map[string][]string
+		if restored, ok := state.Allocations[ip]; ok {
+			owners = restored.Owners
+		}
+		for owner := range alloc.Owners {
+			if _, held := owners[owner]; !held {
+				return fmt.Errorf("the snapshot drops ip %s of pool %s held by %s", ip, p.Name, owner)
+			}
+		}
+	}
+	return nil
+}
+
+// restore replaces the allocations and released ips of p by those of
+// state, which checkRestore accepted.
+func (im *IPAMManager) restore(p *pool, state *PoolState) {
+	p.state.Allocations = make(map[string]*Allocation, len(state.Allocations))
+	p.state.Released = make(map[string]Release, len(state.Released))
+	p.held = nil
+	for ip, alloc := range state.Allocations {
+		p.state.Allocations[ip] = alloc.deepCopy()
+		p.held.add(single(net.ParseIP(ip)))
+	}
+	for ip, release := range state.Released {
+		if _, held := p.state.Allocations[ip]; !held && p.prefixOf(ip) != "" {
+			p.state.Released[ip] = release
+		}
+	}
+	im.persist(p)
+}
@@ -0,0 +1,207 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipam
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// StoreMemory keeps allocations in memory only.
+	StoreMemory = "memory"
+	// StoreCRD keeps allocations in BGPIPsConfig objects.
+	StoreCRD = "crd"
+	// StoreConfigMap keeps allocations in ConfigMaps.
+	StoreConfigMap = "configmap"
+)
+
+// PoolState is the persisted allocation state of a pool.
+type PoolState struct {
+	Name string `json:"name"`
+	Cidr string `json:"cidr"`
+	Free uint   `json:"free"`
+	// Allocations maps every acquired ip to its holders.
+	Allocations map[string]*Allocation `json:"allocations,omitempty"`
+	// Released maps the ips nobody holds anymore to their last release, as
+	// long as the quarantine, the retention or the strategy of the pool
+	// needs it.
+	Released map[string]Release `json:"released,omitempty"`
+	// FromCalico is set for the pools of the Calico cidrs when they are
+	// saved, the stores writing BGPIPsConfigs label theirs with
+	// CalicoPoolLabel.
+	FromCalico bool `json:"-"`
+}
+
+// Release records who gave an ip back and when.
+type Release struct {
+	Owner string    `json:"owner,omitempty"`
+	At    time.Time `json:"at"`
+}
+
+// Allocation records who holds an acquired ip.
+type Allocation struct {
+	// SharingKey lets other services with the same key hold the ip too.
+	SharingKey string `json:"sharingKey,omitempty"`
+	// Owners maps the namespace/name of every holder to the ports it uses,
+	// formatted as protocol/port.
+	Owners map[string][]string `json:"owners"`
+}
+
+// Store persists the allocation state of every pool.
+type Store interface {
+	// Load returns the state recorded for the pool name, or an empty state if
+	// there is none.
+	Load(name string) (*PoolState, error)
+	// Save records state, which is a copy the caller no longer changes.
+	Save(state *PoolState) error
+	// Delete removes the state recorded for the pool name.
+	Delete(name string) error
+}
+
+// ReadOnlyStore loads the state recorded by Store and never writes to it,
+// which lets the state be looked at without changing it.
+type ReadOnlyStore struct {
+	Store
+}
+
+// Save is a no-op.
+func (ReadOnlyStore) Save(state *PoolState) error {
+	return nil
+}
+
+// Delete is a no-op.
+func (ReadOnlyStore) Delete(name string) error {
+	return nil
+}
+
+// NewStore returns the Store named by kind. namespace is the namespace of the
+// BGPIPsConfigs or ConfigMaps the state is persisted into.
+func NewStore(kind string, c client.Client, reader client.Reader, namespace string) (Store, error) {
+	switch kind {
+	case StoreMemory:
+		return NewMemoryStore(), nil
+	case StoreCRD:
+		return NewCRDStore(c, reader, namespace), nil
+	case StoreConfigMap:
+		return NewConfigMapStore(c, reader, namespace), nil
+	}
+	return nil, fmt.Errorf("unknown ipam store %q", kind)
+}
+
+// PoolName returns the name of the pool created for a cidr which is not
+// described by any BGPIPsConfig.
+func PoolName(cidr string) string {
+	return strings.NewReplacer("/", "-", ":", "-").Replace(cidr)
+}
+
+func newPoolState(name string) *PoolState {
+	return &PoolState{
+		Name:        name,
+		Allocations: make(map[string]*Allocation),
+		Released:    make(map[string]Release),
+	}
+}
+
+func (ps *PoolState) deepCopy() *PoolState {
+	out := *ps
+	out.Allocations = make(map[string]*Allocation, len(ps.Allocations))
+	for ip, alloc := range ps.Allocations {
+		out.Allocations[ip] = alloc.deepCopy()
+	}
+	out.Released = make(map[string]Release, len(ps.Released))
+	for ip, release := range ps.Released {
+		out.Released[ip] = release
+	}
+	return &out
+}
+
+func newAllocation(req *Request) *Allocation {
+	return &Allocation{
+		SharingKey: req.SharingKey,
+		Owners:     map[string][]string{req.Owner: req.Ports},
+	}
+}
+
+func (a *Allocation) deepCopy() *Allocation {
+	out := &Allocation{SharingKey: a.SharingKey, Owners: make(map[string][]string, len(a.Owners))}
+	for owner, ports := range a.Owners {
+		out.Owners[owner] = append([]string(nil), ports...)
+	}
+	return out
+}
+
+// shareableWith reports whether req may hold the ip as well, which needs the
+// same sharing key and no port in use by another holder.
+func (a *Allocation) shareableWith(req *Request) bool {
+	if a.SharingKey == "" || a.SharingKey != req.SharingKey {
+		return false
+	}
+	for owner, ports := range a.Owners {
+		if owner == req.Owner {
+			continue
+		}
+		for _, port := range ports {
+			for _, wanted := range req.Ports {
+				if port == wanted {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+// MemoryStore keeps allocations in memory, they are lost on restart.
+type MemoryStore struct {
+	lock  sync.RWMutex
+	pools map[string]*PoolState
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{pools: make(map[string]*PoolState)}
+}
+
+func (s *MemoryStore) Load(name string) (*PoolState, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if state, ok := s.pools[name]; ok {
+		return state.deepCopy(), nil
+	}
+	return newPoolState(name), nil
+}
+
+func (s *MemoryStore) Save(state *PoolState) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.pools[state.Name] = state
+	return nil
+}
+
+func (s *MemoryStore) Delete(name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.pools, name)
+	return nil
+}
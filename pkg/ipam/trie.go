@@ -0,0 +1,132 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipam
+
+import (
+	"net"
+)
+
+// prefixTrie maps the prefixes of the pools to their pool, with one binary
+// trie per ip family. A lookup costs at most one step per address bit
+// however many pools there are.
+type prefixTrie struct {
+	v4 *trieNode
+	v6 *trieNode
+}
+
+type trieNode struct {
+	children [2]*trieNode
+	// pool is set on the node of a prefix of the pool.
+	pool *pool
+}
+
+func newPrefixTrie() *prefixTrie {
+	return &prefixTrie{v4: &trieNode{}, v6: &trieNode{}}
+}
+
+func (t *prefixTrie) root(ip net.IP) *trieNode {
+	if len(ip) == net.IPv4len {
+		return t.v4
+	}
+	return t.v6
+}
+
+// insert maps prefix to p.
+func (t *prefixTrie) insert(prefix *net.IPNet, p *pool) {
+	ip := normalize(prefix.IP)
+	ones, _ := prefix.Mask.Size()
+	node := t.root(ip)
+	for i := 0; i < ones; i++ {
+		b := bit(ip, i)
+		if node.children[b] == nil {
+			node.children[b] = &trieNode{}
+		}
+		node = node.children[b]
+	}
+	node.pool = p
+}
+
+// remove drops prefix and the nodes left without any prefix below them.
+func (t *prefixTrie) remove(prefix *net.IPNet) {
+	ip := normalize(prefix.IP)
+	ones, _ := prefix.Mask.Size()
+	path := []*trieNode{t.root(ip)}
+	for i := 0; i < ones; i++ {
+		next := path[i].children[bit(ip, i)]
+		if next == nil {
+			return
+		}
+		path = append(path, next)
+	}
+	path[ones].pool = nil
+	for i := ones; i > 0; i-- {
+		node := path[i]
+		if node.pool != nil || node.children[0] != nil || node.children[1] != nil {
+			return
+		}
+		path[i-1].children[bit(ip, i-1)] = nil
+	}
+}
+
+// lookup returns the pool of the longest prefix containing ip, or nil.
+func (t *prefixTrie) lookup(ip net.IP) *pool {
+	ip = normalize(ip)
+	node := t.root(ip)
+	found := node.pool
+	for i := 0; i < len(ip)*8 && node != nil; i++ {
+		if node = node.children[bit(ip, i)]; node != nil && node.pool != nil {
+			found = node.pool
+		}
+	}
+	return found
+}
+
+// overlapping returns a pool with a prefix containing or contained in
+// prefix, or nil.
+func (t *prefixTrie) overlapping(prefix *net.IPNet) *pool {
+	ip := normalize(prefix.IP)
+	ones, _ := prefix.Mask.Size()
+	node := t.root(ip)
+	for i := 0; i < ones; i++ {
+		if node.pool != nil {
+			return node.pool
+		}
+		if node = node.children[bit(ip, i)]; node == nil {
+			return nil
+		}
+	}
+	return node.first()
+}
+
+// first returns the pool of any prefix at or below n.
+func (n *trieNode) first() *pool {
+	if n == nil {
+		return nil
+	}
+	if n.pool != nil {
+		return n.pool
+	}
+	if p := n.children[0].first(); p != nil {
+		return p
+	}
+	return n.children[1].first()
+}
+
+// bit returns the i-th bit of ip, starting from the most significant one.
+func bit(ip net.IP, i int) int {
+	return int(ip[i/8]>>(7-uint(i%8))) & 1
+}
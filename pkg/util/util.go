@@ -17,8 +17,19 @@ limitations under the License.
 package util
 
 import (
+	"fmt"
+	"net"
+
 	corev1 "k8s.io/api/core/v1"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// The values of spec.ipFamilyPolicy.
+const (
+	IPFamilyPolicySingleStack      = "SingleStack"
+	IPFamilyPolicyPreferDualStack  = "PreferDualStack"
+	IPFamilyPolicyRequireDualStack = "RequireDualStack"
 )
 
 func ContainsString(slice []string, s string) bool {
@@ -40,6 +51,19 @@ func RemoveString(slice []string, s string) (result []string) {
 	return
 }
 
+// EqualStrings reports whether a and b hold the same strings in the same order.
+func EqualStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
 // IsDeletionCandidate checks if object is candidate to be deleted
 func IsDeletionCandidate(obj v1.Object, finalizer string) bool {
 	return obj.GetDeletionTimestamp() != nil && ContainsString(obj.GetFinalizers(), finalizer)
@@ -50,19 +74,41 @@ func NeedToAddFinalizer(obj v1.Object, finalizer string) bool {
 	return obj.GetDeletionTimestamp() == nil && !ContainsString(obj.GetFinalizers(), finalizer)
 }
 
-// IsNeedReleaseIP checks if need to release ip.
-func IsNeedReleaseIP(obj *corev1.Service, del bool) bool {
-	if len(obj.Status.LoadBalancer.Ingress) > 0 {
-		if obj.Spec.LoadBalancerIP != "" &&
-			obj.Spec.LoadBalancerIP != obj.Status.LoadBalancer.Ingress[0].IP {
-			return true
+// NeedReleaseIPs returns the ingress ips of obj which need to be released.
+// An ip is released when obj is deleted or no longer a LoadBalancer, when its
+// family is not in families, or when obj has more than count ips of its
+// family. spec.loadBalancerIP always takes one of the count ips of its family,
+// the other ips are kept in the order of the ingress.
+func NeedReleaseIPs(obj *corev1.Service, families []corev1.IPFamily, count int, del bool) []string {
+	var ips []string
+	kept := make(map[corev1.IPFamily]int)
+	if obj.Spec.LoadBalancerIP != "" {
+		kept[IPFamilyOf(obj.Spec.LoadBalancerIP)]++
+	}
+	for _, ingress := range obj.Status.LoadBalancer.Ingress {
+		if ingress.IP == "" {
+			continue
 		}
 		if del || obj.Spec.Type != corev1.ServiceTypeLoadBalancer {
-			return true
+			ips = append(ips, ingress.IP)
+			continue
+		}
+		family := IPFamilyOf(ingress.IP)
+		if !containsFamily(families, family) {
+			ips = append(ips, ingress.IP)
+			continue
 		}
+		if ingress.IP == obj.Spec.LoadBalancerIP {
+			continue
+		}
+		if kept[family] >= count {
+			ips = append(ips, ingress.IP)
+			continue
+		}
+		kept[family]++
 	}
 
-	return false
+	return ips
 }
 
 // IsNeedAssignIP checks if need assign a new ip to object.
@@ -72,3 +118,88 @@ func IsNeedAssignIP(obj *corev1.Service) bool {
 	}
 	return false
 }
+
+// ServicePorts returns the ports of obj formatted as protocol/port.
+func ServicePorts(obj *corev1.Service) []string {
+	ports := make([]string, 0, len(obj.Spec.Ports))
+	for _, port := range obj.Spec.Ports {
+		protocol := port.Protocol
+		if protocol == "" {
+			protocol = corev1.ProtocolTCP
+		}
+		ports = append(ports, fmt.Sprintf("%s/%d", protocol, port.Port))
+	}
+	return ports
+}
+
+// IPFamilyOf returns the family of ip.
+func IPFamilyOf(ip string) corev1.IPFamily {
+	if parsed := net.ParseIP(ip); parsed != nil && parsed.To4() == nil {
+		return corev1.IPv6Protocol
+	}
+	return corev1.IPv4Protocol
+}
+
+// ServiceIPFamilies returns the ip families requested by obj and its
+// ipFamilyPolicy. spec.ipFamilies and spec.ipFamilyPolicy are read from raw,
+// the unstructured obj, as they are not part of the typed Service yet. When
+// they are unset the family is derived from spec.ipFamily, spec.clusterIP
+// and spec.loadBalancerIP. Unknown families and policies are an error.
+func ServiceIPFamilies(obj *corev1.Service, raw *unstructured.Unstructured) ([]corev1.IPFamily, string, error) {
+	var families []corev1.IPFamily
+	policy := IPFamilyPolicySingleStack
+	if raw != nil {
+		names, _, err := unstructured.NestedStringSlice(raw.Object, "spec", "ipFamilies")
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid spec.ipFamilies: %v", err)
+		}
+		for _, name := range names {
+			family := corev1.IPFamily(name)
+			if family != corev1.IPv4Protocol && family != corev1.IPv6Protocol {
+				return nil, "", fmt.Errorf("unknown ip family %q in spec.ipFamilies", name)
+			}
+			if containsFamily(families, family) {
+				return nil, "", fmt.Errorf("ip family %s is listed twice in spec.ipFamilies", name)
+			}
+			families = append(families, family)
+		}
+		p, _, err := unstructured.NestedString(raw.Object, "spec", "ipFamilyPolicy")
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid spec.ipFamilyPolicy: %v", err)
+		}
+		switch p {
+		case "":
+		case IPFamilyPolicySingleStack, IPFamilyPolicyPreferDualStack, IPFamilyPolicyRequireDualStack:
+			policy = p
+		default:
+			return nil, "", fmt.Errorf("unknown spec.ipFamilyPolicy %q", p)
+		}
+	}
+
+	if len(families) == 0 {
+		switch {
+		case obj.Spec.IPFamily != nil:
+			families = append(families, *obj.Spec.IPFamily)
+		case obj.Spec.ClusterIP != "" && obj.Spec.ClusterIP != corev1.ClusterIPNone:
+			families = append(families, IPFamilyOf(obj.Spec.ClusterIP))
+		case obj.Spec.LoadBalancerIP != "":
+			families = append(families, IPFamilyOf(obj.Spec.LoadBalancerIP))
+		default:
+			families = append(families, corev1.IPv4Protocol)
+		}
+	}
+	if policy == IPFamilyPolicySingleStack {
+		families = families[:1]
+	}
+
+	return families, policy, nil
+}
+
+func containsFamily(families []corev1.IPFamily, family corev1.IPFamily) bool {
+	for _, f := range families {
+		if f == family {
+			return true
+		}
+	}
+	return false
+}